@@ -0,0 +1,335 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Commands may be run through a copy of up, which prepares the environment of
+// the command, and then executes it. The following environment variables
+// tell the copy what to do.
+const (
+	// helperExecEnv is the path of the command to execute
+	helperExecEnv = "UP_HELPER_EXEC"
+	// helperSandboxEnv, if set, requests remounting file systems read-only
+	helperSandboxEnv = "UP_HELPER_SANDBOX"
+	// helperLimitsEnv lists resource limits to set, as "cpu=SECONDS,as=BYTES"
+	helperLimitsEnv = "UP_HELPER_LIMITS"
+)
+
+func init() {
+	path := os.Getenv(helperExecEnv)
+	if path == "" {
+		return
+	}
+	sandbox, limits := os.Getenv(helperSandboxEnv), os.Getenv(helperLimitsEnv)
+	for _, env := range []string{helperExecEnv, helperSandboxEnv, helperLimitsEnv} {
+		os.Unsetenv(env)
+	}
+	// Capabilities are dropped from the thread which executes the command
+	runtime.LockOSThread()
+	var err error
+	if sandbox != "" {
+		err = remountReadOnly()
+	}
+	if err == nil {
+		err = dropCapabilities()
+	}
+	if err == nil {
+		err = execLimited(path, limits)
+	}
+	fmt.Fprintf(os.Stderr, "up: %s\n", err)
+	os.Exit(126)
+}
+
+// runThroughHelper modifies cmd to be executed by a copy of up, which is
+// given env. Multiple modifications can be combined.
+func runThroughHelper(cmd *exec.Cmd, env ...string) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	if cmd.Path != "/proc/self/exe" {
+		cmd.Env = append(cmd.Env, helperExecEnv+"="+cmd.Path)
+		cmd.Path = "/proc/self/exe"
+	}
+	cmd.Env = append(cmd.Env, env...)
+}
+
+// newNamespaceSandbox returns namespaceSandbox.
+func newNamespaceSandbox() (func(cmd *exec.Cmd), error) {
+	return namespaceSandbox, nil
+}
+
+// namespaceSandbox modifies cmd to run in new user, mount and network
+// namespaces. In them, a copy of up remounts all file systems read-only, and
+// then executes the original command. The new network namespace has no
+// network interfaces other than a loopback.
+func namespaceSandbox(cmd *exec.Cmd) {
+	runThroughHelper(cmd, helperSandboxEnv+"=1")
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	attr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+	// Unless user is root, capabilities in the new user namespace would be
+	// lost on executing up, and it couldn't remount file systems, nor drop
+	// the capabilities which root would regain on executing the command
+	attr.AmbientCaps = []uintptr{capSysAdmin, capSetpcap}
+}
+
+const (
+	capSetpcap             = 8
+	capSysAdmin            = 21
+	prCapbsetDrop          = 24
+	prSetNoNewPrivs        = 38
+	linuxCapabilityVersion = 0x20080522
+)
+
+// dropCapabilities makes sure that the sandboxed command can't remount file
+// systems back as writable, even if it's run by root, who would otherwise
+// keep all capabilities in the user namespace: it clears all capability sets
+// of the thread, including the bounding set, limiting the capabilities which
+// can be gained on executing programs.
+func dropCapabilities() error {
+	for c := uintptr(0); ; c++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, c, 0)
+		if errno == syscall.EINVAL {
+			// No more capabilities known to the kernel
+			break
+		}
+		if errno != 0 {
+			return fmt.Errorf("dropping capabilities: %s", errno)
+		}
+	}
+	// Clearing the permitted set clears the ambient one too
+	header := struct{ version, pid uint32 }{linuxCapabilityVersion, 0}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data)), 0)
+	if errno != 0 {
+		return fmt.Errorf("dropping capabilities: %s", errno)
+	}
+	_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %s", errno)
+	}
+	return nil
+}
+
+// remountReadOnly makes all mounts visible to the process read-only. It must
+// be called in a new mount namespace, so that other processes are not
+// affected.
+func remountReadOnly() error {
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("sandbox: making mounts private: %s", err)
+	}
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return fmt.Errorf("sandbox: %s", err)
+	}
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		// See proc(5) for description of the fields
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		target := unescapeMountPath(fields[4])
+		// Flags which were set on a mount by a more privileged user can't
+		// be cleared, so they must be preserved
+		flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+		for _, opt := range strings.Split(fields[5], ",") {
+			flags |= mountFlags[opt]
+		}
+		err := syscall.Mount("", target, "", flags, "")
+		switch err {
+		case nil:
+		case syscall.ENOENT, syscall.EACCES:
+			// Mounts hidden under other mounts, or inaccessible to the user,
+			// can't be reached by the sandboxed processes anyway
+		default:
+			return fmt.Errorf("sandbox: remounting %s read-only: %s", target, err)
+		}
+	}
+	return nil
+}
+
+var mountFlags = map[string]uintptr{
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"relatime":   syscall.MS_RELATIME,
+}
+
+// unescapeMountPath decodes octal escapes, like '\040' for space, used in
+// paths in /proc/self/mountinfo.
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if ch, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(ch))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// newResourceLimits returns a function modifying commands to run them with
+// limited CPU time, and limited size of virtual memory in bytes. Zero means
+// no limit.
+func newResourceLimits(cpu time.Duration, mem int) (func(cmd *exec.Cmd), error) {
+	var limits []string
+	if cpu > 0 {
+		// Round up, as 0 would mean no limit
+		limits = append(limits, fmt.Sprintf("cpu=%d", (cpu+time.Second-1)/time.Second))
+	}
+	if mem > 0 {
+		limits = append(limits, fmt.Sprintf("as=%d", mem))
+	}
+	env := helperLimitsEnv + "=" + strings.Join(limits, ",")
+	return func(cmd *exec.Cmd) { runThroughHelper(cmd, env) }, nil
+}
+
+var rlimits = map[string]int{
+	"cpu": syscall.RLIMIT_CPU,
+	"as":  syscall.RLIMIT_AS,
+}
+
+// execLimited executes path like syscall.Exec, with resource limits
+// described as in helperLimitsEnv. The limits are set right before, without
+// allocating memory after that, as the Go runtime would crash if it couldn't.
+func execLimited(path string, limits string) error {
+	type resourceLimit struct {
+		name     string
+		resource int
+		rlimit   syscall.Rlimit
+	}
+	var rlims []resourceLimit
+	for _, limit := range strings.Split(limits, ",") {
+		kv := strings.SplitN(limit, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad limit %q: %s", limit, err)
+		}
+		// Soft limit of CPU time makes the process receive SIGXCPU, which
+		// can be caught, so the hard limit is a bit higher
+		rlimit := syscall.Rlimit{Cur: value, Max: value}
+		if kv[0] == "cpu" {
+			rlimit.Max++
+		}
+		rlims = append(rlims, resourceLimit{kv[0], rlimits[kv[0]], rlimit})
+	}
+	argv0, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	argv, err := syscall.SlicePtrFromStrings(os.Args)
+	if err != nil {
+		return err
+	}
+	envv, err := syscall.SlicePtrFromStrings(os.Environ())
+	if err != nil {
+		return err
+	}
+	for i := range rlims {
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, 0, uintptr(rlims[i].resource),
+			uintptr(unsafe.Pointer(&rlims[i].rlimit)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("setting %s limit: %s", rlims[i].name, errno)
+		}
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(argv0)),
+		uintptr(unsafe.Pointer(&argv[0])), uintptr(unsafe.Pointer(&envv[0])))
+	return errno
+}
+
+// limitExceeded returns an error describing which of the limits set by
+// newResourceLimits for cmd was probably exceeded by its process, judging by
+// how it ended, if any.
+func limitExceeded(cmd *exec.Cmd) error {
+	state := cmd.ProcessState
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return nil
+	}
+	var limits string
+	for _, env := range cmd.Env {
+		if strings.HasPrefix(env, helperLimitsEnv+"=") {
+			limits = "," + strings.TrimPrefix(env, helperLimitsEnv+"=")
+		}
+	}
+	limited := func(name string) bool { return strings.Contains(limits, ","+name+"=") }
+	// Shell reports death of its child by a signal with exit status 128+N
+	signal := syscall.Signal(-1)
+	switch {
+	case status.Signaled():
+		signal = status.Signal()
+	case status.Exited() && status.ExitStatus() > 128:
+		signal = syscall.Signal(status.ExitStatus() - 128)
+	}
+	switch {
+	case limited("cpu") && (signal == syscall.SIGXCPU || signal == syscall.SIGKILL):
+		// SIGKILL is sent at the hard limit, if SIGXCPU didn't help
+		return fmt.Errorf("exceeded --cpu-limit (%s)", state)
+	case limited("as") && (signal == syscall.SIGSEGV || signal == syscall.SIGABRT || signal == syscall.SIGBUS):
+		// Failed allocations make many programs crash or abort
+		return fmt.Errorf("exceeded --mem-limit (%s)", state)
+	}
+	return nil
+}
+
+// setProcessGroup makes cmd run in a new process group, so that it can be
+// killed together with all its children.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateProcessGroup asks processes in the process group of p, created by
+// setProcessGroup, to exit.
+func terminateProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGTERM)
+}
+
+// killProcessGroup kills the process group of p, created by setProcessGroup.
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// waitExited waits until p exits, without reaping it, so that its process
+// group ID can't be reused yet. It returns true.
+func waitExited(p *os.Process) bool {
+	const pPID, wNOWAIT = 1, 0x1000000
+	var info [128]byte // siginfo_t
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(p.Pid),
+			uintptr(unsafe.Pointer(&info)), syscall.WEXITED|wNOWAIT, 0, 0)
+		if errno != syscall.EINTR {
+			return true
+		}
+	}
+}
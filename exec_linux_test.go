@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_Pipeline_Kill_noOrphans(t *testing.T) {
+	input := NewBuf(0).StartCapturing(strings.NewReader("foo\n"), func() {})
+	var pipelines []*Pipeline
+	var p *Pipeline
+	for _, command := range []string{
+		"sleep 1000 | sleep 1000",
+		"sleep 1000 & sleep 1000",
+		"(sleep 1000; echo) | cat",
+		// Processes ignoring SIGTERM must be killed with SIGKILL
+		"trap '' TERM; sleep 1000 & sleep 1000",
+		"cat; sleep 1000 | sleep 1000",
+	} {
+		// Restart rapidly, like when typing in unsafe mode
+		p.Kill()
+		p = StartPipeline([]string{"sh", "-c"}, command, input, func() {})
+		pipelines = append(pipelines, p)
+		time.Sleep(20 * time.Millisecond)
+	}
+	p.Kill()
+
+	start := time.Now()
+	for _, p := range pipelines {
+		p.Wait()
+	}
+	if d := time.Since(start); d > killGrace+time.Second {
+		t.Errorf("killing took %s", d)
+	}
+	for _, p := range pipelines {
+		for i, s := range p.procs {
+			if pids := runningInGroup(s.process.Pid); len(pids) > 0 {
+				t.Errorf("%q: processes %v of stage %d survived", strings.Join(p.Stages, " | "), pids, i+1)
+			}
+		}
+	}
+}
+
+// runningInGroup returns IDs of processes in process group pgid, which are
+// not zombies (those may wait long to be reaped by init).
+func runningInGroup(pgid int) []string {
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	var pids []string
+	for _, path := range stats {
+		stat, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// Fields following the command name are: state, ppid, pgrp, ...
+		i := strings.LastIndexByte(string(stat), ')')
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) > 2 && fields[0] != "Z" && fields[2] == strconv.Itoa(pgid) {
+			pids = append(pids, filepath.Base(filepath.Dir(path)))
+		}
+	}
+	return pids
+}
+
+func Test_namespaceSandbox_capabilities(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `grep -E '^(CapPrm|CapEff|CapBnd|NoNewPrivs):' /proc/self/status`)
+	namespaceSandbox(cmd)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Skipf("namespaces not available: %s %s", err, output)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		want := "0000000000000000"
+		if fields[0] == "NoNewPrivs:" {
+			want = "1"
+		}
+		if fields[1] != want {
+			t.Errorf("in sandbox, want %s %s, have %s", fields[0], want, fields[1])
+		}
+	}
+}
+
+func Test_limitExceeded(t *testing.T) {
+	tests := []struct {
+		comment string
+		cpu     time.Duration
+		mem     int
+		command string
+		wantErr string
+	}{
+		{comment: "no limits", command: "kill -SEGV $$"},
+		{comment: "SIGXCPU", cpu: time.Minute, command: "kill -XCPU $$", wantErr: "exceeded --cpu-limit (signal: CPU time limit exceeded)"},
+		{comment: "SIGKILL at hard CPU limit", cpu: time.Minute, command: "kill -KILL $$", wantErr: "exceeded --cpu-limit (signal: killed)"},
+		{comment: "reported by shell", cpu: time.Minute, command: "sh -c 'kill -XCPU $$'", wantErr: "exceeded --cpu-limit (exit status 152)"},
+		{comment: "crash without memory limit", cpu: time.Minute, command: "kill -SEGV $$"},
+		{comment: "crash", mem: 1 << 30, command: "kill -SEGV $$", wantErr: "exceeded --mem-limit (signal: segmentation fault)"},
+		{comment: "abort", mem: 1 << 30, command: "kill -ABRT $$", wantErr: "exceeded --mem-limit (signal: aborted)"},
+		{comment: "exit status 1", mem: 1 << 30, command: "exit 1"},
+		{comment: "exit status 2", mem: 1 << 30, command: "exit 2"},
+		{comment: "command not found", mem: 1 << 30, command: "exit 127"},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("sh", "-c", tt.command)
+		if tt.cpu > 0 || tt.mem > 0 {
+			limit, _ := newResourceLimits(tt.cpu, tt.mem)
+			limit(cmd)
+		}
+		cmd.Run()
+		if err := limitExceeded(cmd); (err != nil || tt.wantErr != "") && fmt.Sprint(err) != tt.wantErr {
+			t.Errorf("%q: want error %q, have %v", tt.comment, tt.wantErr, err)
+		}
+	}
+}
+
+func Test_Subprocess_backgroundJobs(t *testing.T) {
+	input := NewBuf(0).StartCapturing(strings.NewReader(""), func() {})
+	p := StartSubprocess([]string{"sh", "-c"}, "sleep 1000 >/dev/null 2>&1 &", input, ioutil.Discard, func() {})
+	p.Wait()
+	pids := runningInGroup(p.process.Pid)
+	defer syscall.Kill(-p.process.Pid, syscall.SIGKILL)
+	if len(pids) != 1 {
+		t.Errorf("want background job left running after shell exited, have processes %v", pids)
+	}
+}
@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// newNamespaceSandbox reports that namespaces are only supported on Linux;
+// elsewhere, a sandbox wrapper must be used.
+func newNamespaceSandbox() (func(cmd *exec.Cmd), error) {
+	return nil, errors.New("namespaces are only available on Linux")
+}
+
+// newResourceLimits reports that resource limits are only supported on Linux.
+func newResourceLimits(cpu time.Duration, mem int) (func(cmd *exec.Cmd), error) {
+	return nil, errors.New("resource limits are only available on Linux")
+}
+
+func limitExceeded(cmd *exec.Cmd) error {
+	return nil
+}
+
+// setProcessGroup does nothing, as process groups are only used on Linux.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// waitExited returns false, as waiting for a process without reaping it is
+// not supported.
+func waitExited(p *os.Process) bool {
+	return false
+}
@@ -5,7 +5,7 @@ go 1.14
 require (
 	github.com/gdamore/tcell v1.4.0
 	github.com/mattn/go-isatty v0.0.3
-	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/mattn/go-runewidth v0.0.9
 	github.com/spf13/pflag v1.0.3
 	golang.org/x/sys v0.0.0-20201029080932-201ba4db2418 // indirect
 	golang.org/x/text v0.3.4 // indirect
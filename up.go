@@ -20,7 +20,6 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"context"
 	"crypto/sha1"
 	"errors"
 	"fmt"
@@ -29,51 +28,46 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/gdamore/tcell"
 	"github.com/gdamore/tcell/terminfo"
 	"github.com/mattn/go-isatty"
+	"github.com/mattn/go-runewidth"
 	"github.com/spf13/pflag"
 )
 
 const version = "0.4 (2020-10-29)"
 
-// TODO: in case of error, show it in red (bg?), then below show again initial normal output (see also #4)
 // TODO: F1 should display help, and it should be multi-line, and scrolling licensing credits
-// TODO: some key shortcut to increase stdin capture buffer size (unless EOF already reached)
-// TODO: show status infos:
-//  - red fg + "up: process returned with error code %d" -- when subprocess returned an error
-//  - yellow fg -- when process is still not finished
 // TODO: on github: add issues, incl. up-for-grabs / help-wanted
 // TODO: [LATER] make it work on Windows; maybe with mattn/go-shellwords ?
 // TODO: [LATER] Ctrl-O shows input via `less` or $PAGER
 // TODO: properly show all licenses of dependencies on --version
 // TODO: [LATER] on ^X (?), leave TUI and run the command through buffered input, then unpause rest of input
-// TODO: [LATER] allow adding more elements of pipeline (initially, just writing `foo | bar` should work)
-// TODO: [LATER] allow invocation with partial command, like: `up grep -i` (see also #11)
-// TODO: [LATER][MAYBE] allow reading upN.sh scripts (see also #11)
 // TODO: [MUCH LATER] readline-like rich editing support? and completion? (see also #28)
 // TODO: [MUCH LATER] integration with fzf? and pindexis/marker?
-// TODO: [LATER] forking and unforking pipelines (see also #4)
 // TODO: [LATER] capture output of a running process (see: https://stackoverflow.com/q/19584825/98528)
 // TODO: [LATER] richer TUI:
-// - show # of read lines & kbytes
-// - show status (errorlevel) of process, or that it's still running (also with background colors)
 // - allow copying and pasting to/from command line
 // TODO: [LATER] allow connecting external editor (become server/engine via e.g. socket)
 // TODO: [LATER] become pluggable into http://luna-lang.org
 // TODO: [LATER][MAYBE] allow "plugins" ("combos" - commands with default options) e.g. for Lua `lua -e`+auto-quote, etc.
 // TODO: [LATER] make it more friendly to infrequent Linux users by providing "descriptive" commands like "search" etc.
 // TODO: [LATER] advertise on some reddits for data exploration / data science
-// TODO: [LATER] undo/redo - history of commands (see also #4)
-// TODO: [LATER] jump between buffers saved from earlier pipe fragments; OR: allow saving/recalling "snapshots" of (cmd, results) pairs (see also #4)
 // TODO: [LATER] ^-, U -- to switch to "unsafe mode"? -u to switch back? + some visual marker
 
 func init() {
 	pflag.Usage = func() {
-		fmt.Fprint(os.Stderr, `Usage: COMMAND | up [OPTIONS]
+		fmt.Fprint(os.Stderr, `Usage: COMMAND | up [OPTIONS] [PIPELINE...]
+   or: up [OPTIONS] FILE...
 
 up is the Ultimate Plumber, a tool for writing Linux pipes in a terminal-based
 UI interactively, with instant live preview of command results.
@@ -88,28 +82,81 @@ screen can be edited in order to interactively build a pipeline. Every time you
 hit [Enter], the bottom of the screen will display the results of passing the
 up's standard input through the pipeline (executed using your default $SHELL).
 
+The initial pipeline can be given after the options, e.g. 'up grep -i', which
+is convenient in shell aliases. Multiple words are quoted for the shell as
+needed, so 'up jq ".[] | .name"' works as expected, while a single word is used
+as is, so 'up "sort | uniq -c"' is a pipeline of two commands. Use --run to
+execute the initial pipeline without waiting for [Enter].
+
+If nothing is piped to up, the arguments are instead names of files to read as
+input. Input can also be read from files given with --input, or from output of
+a command given with --input-cmd; in both cases, Alt-R reads the input again
+(unless standard input, given as '-', is among the files).
+
 If a tilde '~' is visible in top-left corner, it indicates that Ultimate
 Plumber did not yet fully consume its input. Some pipelines may not finish with
 incomplete input; use Ctrl-S to freeze reading the input and to inject fake
 EOF; use Ctrl-Q to unfreeze back and continue reading.
 
 If a plus '+' is visible in top-left corner, the internal buffer limit
-(default: 40MB) was reached and Ultimate Plumber won't read more input.
+(default: 40MB) was reached and Ultimate Plumber stopped reading more input;
+use Alt-+ to raise the limit and continue reading.
+
+With --auto-safe, the pipeline is also executed while you type, but only if it
+looks free of side effects: all its commands are listed in --safe-commands, and
+it doesn't redirect output to files. Otherwise, the reason is shown in the
+bottom-right corner, and the pipeline waits for [Enter]. The bottom-right
+corner also shows 'unsafe' when --unsafe-full-throttle is used.
 
 KEYS
 
 - alphanumeric & symbol keys, Left, Right, Ctrl-A/E/B/F/K/Y/W
                       - navigate and edit the pipeline command
+- Ctrl-Z, Ctrl-_      - undo last change of the pipeline command
+- Ctrl-Shift-Z, Alt-Z - redo last undone change of the pipeline command
+- Ctrl-P, Ctrl-N      - recall previous/next command from history
+- Ctrl-R  - incremental reverse search in history; Ctrl-R again finds an
+            older match, Ctrl-G cancels the search
 - Enter   - execute the pipeline command, updating the pipeline output panel
 - Up, Dn, PgUp, PgDn, Ctrl-Left, Ctrl-Right
                       - navigate (scroll) the pipeline output panel
+- Home, End, Alt-g, Alt-G
+                      - jump to start/end of the pipeline output panel
+- Alt-/, Alt-?        - search forward/backward in the pipeline output panel,
+                        highlighting all matches; in the search prompt, use
+                        Ctrl-R to toggle between literal text and regexp, and
+                        Enter with empty text to remove highlighting
+- Alt-N, Alt-Shift-N  - jump to next/previous match of the search
+- Alt-W   - toggle wrap mode, in which long lines of the pipeline output panel
+            are continued in the following rows (marked with '\' at the end
+            of the row) instead of being clipped
+- Alt-T   - toggle follow mode, in which the pipeline output panel keeps
+            showing its last lines as more data arrives (shows 'F' indicator
+            in top-left corner); enabled at start, disabled by scrolling up,
+            and enabled again by scrolling to the bottom
+- Alt-E   - switch between showing error messages (standard error) of the
+            pipeline in a red pane below its output, instead of its output,
+            or not at all
+- Alt-Up, Alt-Dn      - show output of previous/next stage of the pipeline
+                        (stages are separated with '|'; stage 0 is the input)
+- Alt-S   - save a snapshot of the displayed output and the command producing it
+- Alt-L   - list saved snapshots; choosing one restores its command and output
+            without rerunning it
+- Alt-F   - fork: use the displayed output as the new input of the pipeline,
+            so that the command producing it is not rerun (shows '[N]|' prompt)
+- Alt-B   - unfork: go back to the input from before the last fork
 - Ctrl-X  - exit and write the pipeline to up1.sh (or if it exists then to
-            up2.sh, etc. till up1000.sh)
+            up2.sh, etc. till up1000.sh); or to the file given with -o or
+            --script; see also --output-format
 - Ctrl-C  - quit without saving and emit the pipeline on standard output
 - Ctrl-S  - temporarily freeze a long-running input to Ultimate Plumber,
             injecting a fake EOF into the buffer (shows '#' indicator in
             top-left corner)
 - Ctrl-Q  - unfreeze back after Ctrl-S (disables '#' indicator)
+- Alt-R   - read the input again from --input files or --input-cmd, and rerun
+            the pipeline
+- Alt-+   - raise the buffer limit by the --buf size, if it was reached
+            (indicated by '+' in top-left corner), and continue reading
 
 OPTIONS
 `)
@@ -124,20 +171,97 @@ VERSION: `+version+`
 
 var (
 	// TODO: dangerous? immediate? raw? unsafe? ...
-	// FIXME(akavel): mark the unsafe mode vs. safe mode with some colour or status; also inform/mark what command's results are displayed...
 	unsafeMode   = pflag.Bool("unsafe-full-throttle", false, "enable mode in which pipeline is executed immediately after any change (without pressing Enter)")
+	autoSafe     = pflag.Bool("auto-safe", false, "enable mode in which pipeline is executed immediately after any change, but only if it runs just --safe-commands and doesn't redirect output to files")
+	safeCommands = pflag.StringSlice("safe-commands", defaultSafeCommands, "`names` of commands considered free of side effects in --auto-safe mode")
+	debounce     = pflag.Duration("debounce", 300*time.Millisecond, "in --unsafe-full-throttle and --auto-safe modes, run the pipeline only after it was not changed for this `duration`")
 	outputScript = pflag.StringP("output-script", "o", "", "save the command to specified `file` if Ctrl-X is pressed (default: up<N>.sh)")
+	scriptFile   = pflag.String("script", "", "load pipeline and shell from a `file` saved earlier with Ctrl-X, and save it back there on Ctrl-X")
+	outputFormat = pflag.String("output-format", "script", "`format` of the file saved with Ctrl-X: an executable 'script', a shell 'function' to source, or a 'make' target (default file: up<N>.mk)")
+	inputSource  = pflag.String("input-source", "", "`command` which produced the input of up, to be noted in a comment of the file saved with Ctrl-X")
 	debugMode    = pflag.Bool("debug", false, "debug mode")
 	noColors     = pflag.Bool("no-colors", false, "disable interface colors")
 	shellFlag    = pflag.StringArrayP("exec", "e", nil, "`command` to run pipeline with; repeat multiple times to pass multi-word command; defaults to '-e=$SHELL -e=-c'")
-	initialCmd   = pflag.StringP("pipeline", "c", "", "initial `commands` to use as pipeline (default empty)")
-	bufsize      = pflag.Int("buf", 40, "input buffer size & pipeline buffer sizes in `megabytes` (MiB)")
+	sandboxFlag  = pflag.Bool("sandbox", false, "run pipeline with a read-only view of the file system and without network access, using bwrap if found in $PATH, or else Linux namespaces")
+	sandboxCmd   = pflag.StringArray("sandbox-wrapper", nil, "`command` to wrap pipeline in, in --sandbox mode, instead of the default; repeat multiple times to pass multi-word command")
+	cpuLimit     = pflag.Duration("cpu-limit", 0, "limit of CPU time used by each process of the pipeline, e.g. 10s; 0 means no limit")
+	memLimit     = pflag.Int("mem-limit", 0, "limit of virtual memory of each process of the pipeline in `megabytes` (MiB); 0 means no limit")
+	timeout      = pflag.Duration("timeout", 0, "kill each stage of the pipeline when it runs longer than this `duration`; 0 means no limit")
+	initialCmd   = pflag.StringP("pipeline", "c", "", "initial `commands` to use as pipeline (default empty); can also be given as arguments following the options")
+	runInitial   = pflag.Bool("run", false, "execute the initial pipeline immediately, without waiting for Enter")
+	historyFile  = pflag.String("history", "", "`file` where history of executed commands is kept, or empty to disable (default: $XDG_STATE_HOME/up/history)")
+	bufsize      = pflag.Int("buf", 40, "limit of input buffer size & pipeline buffer sizes in `megabytes` (MiB), can be raised with Alt-+; 0 means no limit")
+	memsize      = pflag.Int("mem", 100, "size in `megabytes` (MiB) above which each buffer is spilled to a temporary file in $TMPDIR; 0 means never")
 	noinput      = pflag.Bool("noinput", false, "start with empty buffer regardless if any input was provided")
+	inputFiles   = pflag.StringArray("input", nil, "read input from `file` instead of standard input; may be repeated, or be a glob pattern; '-' means standard input")
+	inputCmd     = pflag.String("input-cmd", "", "read input from output (and error messages) of `command` run in shell, instead of standard input; Alt-R runs it again")
 )
 
 func main() {
-	// Handle command-line flags
+	// Handle command-line flags. Options of up end at the first argument, so
+	// that `up grep -i` passes '-i' to grep.
+	pflag.CommandLine.SetInterspersed(false)
 	pflag.Parse()
+	// If nothing is piped to up, the arguments are input files
+	files := pflag.Args()
+	if len(files) > 0 && len(*inputFiles) == 0 && *inputCmd == "" && !*noinput && isatty.IsTerminal(os.Stdin.Fd()) {
+		*inputFiles = files
+	} else if len(files) > 0 {
+		if *initialCmd != "" {
+			die("initial pipeline given both with -c and as arguments: " + *initialCmd + " and " + strings.Join(files, " "))
+		}
+		*initialCmd = argsCommand(files)
+	}
+	if len(*inputFiles) > 0 && *inputCmd != "" {
+		die("input given both with --input-cmd and as files: " + *inputCmd + " and " + strings.Join(*inputFiles, " "))
+	}
+	files, err := globInputs(*inputFiles)
+	if err != nil {
+		die(err.Error() + "; to use arguments as the initial pipeline, pipe some data to up, or use --input or --input-cmd")
+	}
+	switch *outputFormat {
+	case "script", "function", "make":
+	default:
+		die("unknown --output-format: " + *outputFormat + ", expected one of: script, function, make")
+	}
+	// A script saved earlier can be edited again, with the same shell
+	script := &Script{}
+	if *scriptFile != "" {
+		loaded, err := ReadScript(*scriptFile)
+		switch {
+		case os.IsNotExist(err):
+			// A new script will be created on Ctrl-X
+		case err != nil:
+			die(err.Error())
+		case *initialCmd != "" && loaded.Command != "":
+			die("initial pipeline given both in --script and as -c or arguments: " + loaded.Command + " and " + *initialCmd)
+		default:
+			script = loaded
+			if *initialCmd == "" {
+				*initialCmd = script.Command
+			}
+			if len(*shellFlag) == 0 {
+				*shellFlag = script.Shell
+			} else {
+				script.Interpreter = ""
+			}
+		}
+		if *outputScript == "" {
+			*outputScript = *scriptFile
+		}
+	}
+	switch {
+	case *inputSource != "":
+		script.Input = *inputSource
+	case *inputCmd != "":
+		script.Input = *inputCmd
+	case len(files) > 0:
+		quoted := make([]string, len(files))
+		for i, f := range files {
+			quoted[i] = shellQuote(f)
+		}
+		script.Input = "cat " + strings.Join(quoted, " ")
+	}
 
 	log.SetOutput(ioutil.Discard)
 	if *debugMode {
@@ -173,63 +297,226 @@ func main() {
 	}
 	log.Println("found shell:", shell)
 
+	// Optionally, protect the system from mistakes in typed commands
+	sandboxErr := error(nil)
+	if *sandboxFlag {
+		confine, sandboxErr = setupSandbox(*sandboxCmd)
+	}
+	if *cpuLimit > 0 || *memLimit > 0 {
+		limit, err := newResourceLimits(*cpuLimit, *memLimit*1024*1024)
+		if err != nil {
+			die(err.Error())
+		}
+		if sandbox := confine; sandbox != nil {
+			confine = func(cmd *exec.Cmd) {
+				sandbox(cmd)
+				limit(cmd)
+			}
+		} else {
+			confine = limit
+		}
+	}
+
 	stdin := io.Reader(os.Stdin)
 	if *noinput {
 		stdin = bytes.NewReader(nil)
-	} else if isatty.IsTerminal(os.Stdin.Fd()) {
+	} else if usesStdin(files, *inputCmd) && isatty.IsTerminal(os.Stdin.Fd()) {
 		// TODO: Without this block, we'd hang when nothing is piped on input (see
 		// github.com/peco/peco, mattn/gof, fzf, etc.)
-		die("up requires some data piped on standard input, for example try: `echo hello world | up`")
+		die("up requires some data piped on standard input, or input files, for example try: `echo hello world | up` or `up FILE`")
 	}
 
 	// Initialize TUI infrastructure
 	tui := initTUI()
 	defer tui.Fini()
+	defer removeSpillFiles()
+	// New data arrives in many small pieces, so redraws caused by it are
+	// throttled, to not waste CPU on redrawing more often than anyone can see
+	refresh := NewThrottle(refreshInterval, func() { triggerRefresh(tui) })
+
+	// Commands executed earlier can be recalled in the editor
+	if !pflag.CommandLine.Changed("history") {
+		*historyFile = defaultHistoryPath()
+	}
+	history, historyErr := LoadHistory(*historyFile)
 
 	// Initialize 3 main UI parts
 	var (
 		// The top line of the TUI is an editable command, which will be used
 		// as a pipeline for data we read from stdin
 		commandEditor = NewEditor("| ", *initialCmd)
-		// The rest of the screen is a view of the results of the command
-		commandOutput = BufView{}
+		// The rest of the screen is a view of the results of the command,
+		// following them as they arrive until user scrolls up
+		commandOutput = BufView{Follow: true}
+		// Error messages of the command are shown separately from its results
+		commandErrors = BufView{Follow: true}
+		errorsMode    = errorsPane
+		// When a command fails without any output, results of the last
+		// successful one are shown instead
+		lastGood        = BufView{}
+		lastGoodCommand = ""
 		// Sometimes, a message may be displayed at the bottom of the screen, with help or other info
 		message = `Enter runs  ^X exit (^C nosave)  PgUp/PgDn/Up/Dn/^</^> scroll  ^S pause (^Q end)  [Ultimate Plumber v` + version + ` by akavel et al.]`
 	)
+	if historyErr != nil {
+		message = historyErr.Error()
+	}
+	if sandboxErr != nil {
+		message = "WARNING: sandbox unavailable, pipeline will NOT be sandboxed: " + sandboxErr.Error()
+	}
+
+	// Input files or command given in options can be read again on request
+	var (
+		inputProcess *Subprocess   // running --input-cmd, if any
+		inputStop    chan struct{} // closed to stop reading input files
+	)
+	startInput := func() *Buf {
+		buf := NewBuf(*bufsize * 1024 * 1024)
+		switch {
+		case *noinput:
+			buf.StartCapturing(stdin, refresh.Call)
+		case *inputCmd != "":
+			inputProcess = StartInput(shell, *inputCmd, buf, refresh.Call)
+		case len(files) > 0:
+			inputStop = make(chan struct{})
+			buf.StartCapturing(readFiles(files, inputStop), refresh.Call)
+		default:
+			buf.StartCapturing(stdin, refresh.Call)
+		}
+		return buf
+	}
+	stopInput := func() {
+		inputProcess.Kill()
+		if inputStop != nil {
+			close(inputStop)
+			inputStop = nil
+		}
+	}
 
 	// Initialize main data flow
 	var (
-		// We capture data piped to 'up' on standard input into an internal buffer
-		// When some new data shows up on stdin, we raise a custom signal,
-		// so that main loop will refresh the buffers and the output.
-		stdinCapture = NewBuf(*bufsize*1024*1024).
-				StartCapturing(stdin, func() { triggerRefresh(tui) })
-		// Then, we pass this data as input to a subprocess.
+		// We capture data piped to 'up' on standard input (or read from input
+		// files or command) into an internal buffer. When some new data shows
+		// up, we raise a custom signal, so that main loop will refresh the
+		// buffers and the output.
+		stdinCapture = startInput()
+		// Then, we pass this data as input to a pipeline of subprocesses.
 		// Initially, no subprocess is running, as no command is entered yet
-		commandSubprocess *Subprocess = nil
+		commandPipeline *Pipeline = nil
+		// Index of the pipeline stage whose output is currently displayed
+		stage = 0
+		// Outputs of commands saved by user for later recall
+		snapshots []Snapshot
+		// When not nil, user is picking a snapshot to restore
+		snapshotMenu *Menu
+		// Stack of earlier inputs, from before user forked the pipeline
+		forks forkStack
+		// The command which was most recently started
+		lastCommand = ""
+		// When not nil, user is typing a text to search for in the output
+		searchEditor *Editor
+		// Direction and mode of the most recent search
+		searchForward = true
+		searchRegexp  = false
 	)
+	searchPrompt := func() string {
+		prompt := "/"
+		if !searchForward {
+			prompt = "?"
+		}
+		if searchRegexp {
+			prompt = "regexp " + prompt
+		}
+		return prompt
+	}
+	// shownCommand returns the command which produced the currently displayed output
+	shownCommand := func() string {
+		switch {
+		case commandPipeline != nil:
+			return strings.Join(commandPipeline.Stages[:stage], " | ")
+		case commandOutput.Buf != stdinCapture:
+			// Output of an earlier restored snapshot
+			return lastCommand
+		default:
+			return ""
+		}
+	}
+	// fullCommand returns the edited command, prefixed with all forked commands
+	fullCommand := func() string {
+		return forks.command(commandEditor.String())
+	}
 	// Intially, for user's convenience, show the raw input data, as if `cat` command was typed
 	commandOutput.Buf = stdinCapture
+	commandEditor.History = history
+
+	// Run time of a running command, shown in the status bar, needs to be
+	// refreshed periodically
+	refreshTimer := time.AfterFunc(time.Second, func() { triggerRefresh(tui) })
+	// In unsafe mode, the command is run when user stops typing for a while
+	debounceTimer := time.AfterFunc(time.Hour, func() { triggerRefresh(tui) })
+	debounceTimer.Stop()
 
 	// Main loop
-	lastCommand := ""
-	restart := false
+	restart := *runInitial && commandEditor.String() != ""
+	recorded := false   // whether commandPipeline was already added to history
+	editedCommand := "" // command as it was after the most recent edit
+	editedAt := time.Now()
+	interrupted := false // whether commandPipeline was killed before finishing
 	for {
-		// If user edited the command, immediately run it in background, and
-		// kill the previously running command.
+		// If user edited the command, run it in background as soon as user
+		// pauses typing, and kill the previously running command.
 		command := commandEditor.String()
-		if restart || (*unsafeMode && command != lastCommand) {
-			commandSubprocess.Kill()
+		// In auto-safe mode, the command is run live only if it's harmless
+		notSafe := error(nil)
+		if !*unsafeMode && *autoSafe {
+			notSafe = checkSideEffects(command, *safeCommands)
+		}
+		live := *unsafeMode || (*autoSafe && notSafe == nil)
+		if live && command != editedCommand {
+			editedCommand, editedAt = command, time.Now()
+			// Results of the running command are already outdated, so
+			// don't waste resources on it
+			if commandPipeline != nil {
+				if done, _ := commandPipeline.Finished(); !done {
+					commandPipeline.Kill()
+					interrupted = true
+				}
+			}
+		}
+		outdated := live && (command != lastCommand || interrupted)
+		if wait := *debounce - time.Since(editedAt); outdated && !restart && wait > 0 {
+			debounceTimer.Reset(wait)
+		} else if restart || outdated {
+			commandPipeline.Kill()
 			if command != "" {
-				commandSubprocess = StartSubprocess(shell, command, stdinCapture, func() { triggerRefresh(tui) })
-				commandOutput.Buf = commandSubprocess.Buf
+				commandPipeline = StartPipeline(shell, command, stdinCapture, refresh.Call)
+				stage = len(commandPipeline.Stages)
+				commandOutput.Buf = commandPipeline.Buf(stage)
+				commandErrors.Buf = commandPipeline.Stderr
 			} else {
 				// If command is empty, show original input data again (~ equivalent of typing `cat`)
-				commandSubprocess = nil
+				commandPipeline = nil
+				stage = 0
 				commandOutput.Buf = stdinCapture
 			}
-			restart = false
+			restart, interrupted = false, false
 			lastCommand = command
+			recorded = false
+		}
+		if commandPipeline != nil {
+			if done, err := commandPipeline.Finished(); done && err == nil {
+				// In live modes, only successfully completed runs are worth
+				// remembering, as most others are just partially typed commands.
+				if (*unsafeMode || *autoSafe) && !recorded {
+					if err := history.Add(lastCommand); err != nil {
+						message = err.Error()
+					}
+					recorded = true
+				}
+				if out := commandPipeline.Buf(len(commandPipeline.Stages)); lastGood.Buf != out {
+					lastGood, lastGoodCommand = BufView{Buf: out}, lastCommand
+				}
+			}
 		}
 
 		// Draw UI
@@ -239,23 +526,156 @@ func main() {
 			style = whiteOnDBlue
 		}
 		stdinCapture.DrawStatus(TuiRegion(tui, 0, 0, 1, 1), style)
-		commandEditor.DrawTo(TuiRegion(tui, 1, 0, w-1, 1), style,
-			func(x, y int) { tui.ShowCursor(x+1, 0) })
-		commandOutput.DrawTo(TuiRegion(tui, 0, 1, w, h-1))
-		drawText(TuiRegion(tui, 0, h-1, w, 1), whiteOnBlue, message)
+		commandOutput.DrawStatus(TuiRegion(tui, 1, 0, 1, 1), style)
+		commandEditor.DrawTo(TuiRegion(tui, 2, 0, w-2, 1), style,
+			func(x, y int) { tui.ShowCursor(x+2, 0) })
+		// Below the output, there may be a pane with error messages
+		outputH, errorsH := h-2, 0
+		if commandPipeline != nil && errorsMode == errorsPane && commandPipeline.Stderr.Size() > 0 {
+			errorsH = commandPipeline.Stderr.textLines()
+			if errorsH > outputH/3 {
+				errorsH = outputH / 3
+			}
+			outputH -= errorsH + 1
+		}
+		failed := commandPipeline != nil && stage == len(commandPipeline.Stages) &&
+			commandOutput.Buf.Size() == 0 && lastGood.Buf != nil && commandPipeline.Failed()
+		shownView, shownY := &commandOutput, 1
+		switch {
+		case commandPipeline != nil && errorsMode == errorsOnly:
+			shownView = &commandErrors
+			commandErrors.DrawTo(errorsRegion(TuiRegion(tui, 0, 1, w, outputH)))
+		case failed:
+			shownView, shownY = &lastGood, 2
+			drawLastGood(TuiRegion(tui, 0, 1, w, outputH), &lastGood, lastGoodCommand)
+		default:
+			commandOutput.DrawTo(TuiRegion(tui, 0, 1, w, outputH))
+		}
+		shownView.DrawPosition(TuiRegion(tui, 0, shownY, w, 1), whiteOnBlue)
+		if errorsH > 0 {
+			drawText(TuiRegion(tui, 0, 1+outputH, w, 1), whiteOnRed, strings.Repeat(" ", w))
+			drawText(TuiRegion(tui, 0, 1+outputH, w, 1), whiteOnRed, "standard error (Alt-E switches view)")
+			commandErrors.DrawTo(errorsRegion(TuiRegion(tui, 0, 2+outputH, w, errorsH)))
+		}
+		if snapshotMenu != nil {
+			snapshotMenu.DrawTo(TuiRegion(tui, 0, 1, w, h-2))
+		}
+		status := StatusBar{Buf: commandOutput.Buf}
+		if shownView == &commandErrors {
+			status.Buf, status.Info = commandErrors.Buf, "standard error"
+		} else if commandPipeline != nil && commandOutput.Buf == commandPipeline.Buf(stage) {
+			status.Procs = commandPipeline.Procs(stage)
+			if stage < len(commandPipeline.Stages) {
+				// Make it clear that we're not showing the final output of the pipeline
+				info := "(input)"
+				if stage > 0 {
+					info = "| " + commandPipeline.Stages[stage-1]
+				}
+				status.Info = fmt.Sprintf("stage %d/%d %s", stage, len(commandPipeline.Stages), info)
+			}
+		}
+		switch {
+		case *unsafeMode:
+			status.Mode, status.ModeStyle = "unsafe", whiteOnRed
+		case *autoSafe && notSafe != nil && command != lastCommand:
+			status.Mode, status.ModeStyle = "auto-safe: Enter runs ("+notSafe.Error()+")", blackOnYellow
+		case *autoSafe:
+			status.Mode, status.ModeStyle = "auto-safe", whiteOnBlue
+		}
+		if *sandboxFlag && sandboxErr == nil {
+			status.Mode = strings.TrimSuffix("sandbox, "+status.Mode, ", ")
+		}
+		if status.Running() {
+			refreshTimer.Reset(time.Second)
+		}
+		if message == "" {
+			status.DrawTo(TuiRegion(tui, 0, h-1, w, 1))
+		} else {
+			drawText(TuiRegion(tui, 0, h-1, w, 1), whiteOnBlue, strings.Repeat(" ", w))
+			drawText(TuiRegion(tui, 0, h-1, w, 1), whiteOnBlue, message)
+		}
+		if searchEditor != nil {
+			drawText(TuiRegion(tui, 0, h-1, w, 1), whiteOnBlue, strings.Repeat(" ", w))
+			searchEditor.DrawTo(TuiRegion(tui, 0, h-1, w, 1), whiteOnBlue,
+				func(x, y int) { tui.ShowCursor(x, h-1) })
+		}
 		tui.Show()
 
 		// Handle UI events
 		switch ev := tui.PollEvent().(type) {
 		// Key pressed
 		case *tcell.EventKey:
+			// Is it a key for picking a snapshot?
+			if snapshotMenu != nil {
+				switch getKey(ev) {
+				case key(tcell.KeyEnter):
+					// Restore command & its output, without rerunning it
+					snap := snapshots[snapshotMenu.Selected]
+					commandPipeline.Kill()
+					commandPipeline, stage = nil, 0
+					snap.Restore(commandEditor, &commandOutput)
+					lastCommand = snap.Command
+					snapshotMenu = nil
+					message = ""
+				case key(tcell.KeyDelete):
+					snapshots = append(snapshots[:snapshotMenu.Selected], snapshots[snapshotMenu.Selected+1:]...)
+					snapshotMenu.Items = append(snapshotMenu.Items[:snapshotMenu.Selected], snapshotMenu.Items[snapshotMenu.Selected+1:]...)
+					if len(snapshots) == 0 {
+						snapshotMenu, message = nil, ""
+					} else if snapshotMenu.Selected == len(snapshots) {
+						snapshotMenu.Selected--
+					}
+				case key(tcell.KeyEscape),
+					key(tcell.KeyCtrlG),
+					ctrlKey(tcell.KeyCtrlG):
+					snapshotMenu, message = nil, ""
+				default:
+					snapshotMenu.HandleKey(ev, h-2)
+				}
+				continue
+			}
+			// Is it a key for typing a search query?
+			if searchEditor != nil {
+				switch getKey(ev) {
+				case key(tcell.KeyEnter):
+					query := searchEditor.String()
+					searchEditor = nil
+					if query == "" {
+						commandOutput.Search = nil
+						break
+					}
+					if !searchRegexp {
+						query = regexp.QuoteMeta(query)
+					}
+					re, err := regexp.Compile(query)
+					if err != nil {
+						message = "bad regexp: " + err.Error()
+						break
+					}
+					commandOutput.Search = re
+					if !commandOutput.FindNext(searchForward, w) {
+						message = "pattern not found"
+					}
+				case key(tcell.KeyEscape),
+					key(tcell.KeyCtrlG),
+					ctrlKey(tcell.KeyCtrlG):
+					searchEditor = nil
+				case key(tcell.KeyCtrlR),
+					ctrlKey(tcell.KeyCtrlR):
+					searchRegexp = !searchRegexp
+					searchEditor.prompt = []rune(searchPrompt())
+				default:
+					searchEditor.HandleKey(ev)
+				}
+				continue
+			}
 			// Is it a command editor key?
 			if commandEditor.HandleKey(ev) {
 				message = ""
 				continue
 			}
 			// Is it a command output view key?
-			if commandOutput.HandleKey(ev, h-1) {
+			if shownView.HandleKey(ev, outputH) {
 				message = ""
 				continue
 			}
@@ -263,32 +683,155 @@ func main() {
 			switch getKey(ev) {
 			case key(tcell.KeyEnter):
 				restart = true
-			case key(tcell.KeyCtrlUnderscore),
-				ctrlKey(tcell.KeyCtrlUnderscore):
-				// TODO: ask for another character to trigger command-line option, like in `less`
-
+				if err := history.Add(command); err != nil {
+					message = err.Error()
+				}
+			case altKey(tcell.KeyUp),
+				ctrlKey(tcell.KeyUp):
+				if commandPipeline != nil && stage > 0 {
+					stage--
+					commandOutput.Buf = commandPipeline.Buf(stage)
+					commandOutput.normalizeY()
+				}
+			case altKey(tcell.KeyDown),
+				ctrlKey(tcell.KeyDown):
+				if commandPipeline != nil && stage < len(commandPipeline.Stages) {
+					stage++
+					commandOutput.Buf = commandPipeline.Buf(stage)
+					commandOutput.normalizeY()
+				}
+			case altRune('e'):
+				errorsMode = (errorsMode + 1) % errorsModes
+			case altRune('/'),
+				altRune('?'):
+				searchForward = getKey(ev) == altRune('/')
+				searchEditor = NewEditor(searchPrompt(), "")
+				message = ""
+			case altRune('n'),
+				altRune('N'):
+				if commandOutput.Search == nil {
+					message = "nothing to search for; press Alt-/ to search"
+					break
+				}
+				forward := searchForward == (getKey(ev) == altRune('n'))
+				if !commandOutput.FindNext(forward, w) {
+					message = "pattern not found"
+				}
+			case altRune('s'):
+				// Save a snapshot of the currently displayed output and the
+				// command which produced it
+				cmd := shownCommand()
+				snapshots = append(snapshots, Snapshot{
+					Command: cmd,
+					Buf:     commandOutput.Buf.Snapshot(),
+				})
+				message = fmt.Sprintf("saved snapshot #%d: | %s", len(snapshots), cmd)
+			case altRune('l'):
+				if len(snapshots) == 0 {
+					message = "no snapshots saved yet; press Alt-S to save one"
+					break
+				}
+				snapshotMenu = NewSnapshotMenu(snapshots)
+				message = "Enter restores snapshot  Del removes it  Esc cancels"
+			case altRune('f'):
+				// Fork: use the displayed output as the new input; any
+				// further stages of the pipeline become the new command
+				if commandOutput.Buf == stdinCapture {
+					message = "nothing to fork; run some command first"
+					break
+				}
+				f := fork{input: stdinCapture, command: shownCommand()}
+				rest := ""
+				if commandPipeline != nil {
+					rest = strings.Join(commandPipeline.Stages[stage:], " | ")
+					commandPipeline.KillAfter(stage)
+					f.pipeline = commandPipeline
+				}
+				forks.push(f)
+				stdinCapture = commandOutput.Buf
+				commandPipeline, stage = nil, 0
+				commandEditor.edit(editOther, func() { commandEditor.set(rest) })
+				commandEditor.prompt = []rune(forks.prompt())
+				lastCommand = ""
+				restart = true
+				message = "forked: | " + f.command + "  (Alt-B unforks)"
+			case altRune('b'):
+				// Unfork: go back to the input from before the last fork
+				if len(forks) == 0 {
+					message = "nothing to unfork"
+					break
+				}
+				f, cmd := forks.pop(commandEditor.String())
+				commandPipeline.Kill()
+				f.pipeline.Kill()
+				commandPipeline, stage = nil, 0
+				stdinCapture = f.input
+				commandEditor.edit(editOther, func() { commandEditor.set(cmd) })
+				commandEditor.prompt = []rune(forks.prompt())
+				lastCommand = ""
+				restart = true
+				message = ""
+			case altRune('r'):
+				// Read the input again, e.g. to see new results of --input-cmd
+				if *noinput || usesStdin(files, *inputCmd) {
+					message = "standard input can't be read again; use --input files other than '-', or --input-cmd"
+					break
+				}
+				// Forked outputs were produced from the old input, so
+				// the forked commands need to be rerun as well
+				if len(forks) > 0 {
+					cmd := fullCommand()
+					commandPipeline.Kill()
+					forks.kill()
+					forks = nil
+					commandEditor.edit(editOther, func() { commandEditor.set(cmd) })
+					commandEditor.prompt = []rune(forks.prompt())
+				}
+				stopInput()
+				stdinCapture = startInput()
+				commandPipeline, stage = nil, 0
+				lastCommand = ""
+				restart = true
+				message = "reading input again"
 			case key(tcell.KeyCtrlS),
 				ctrlKey(tcell.KeyCtrlS):
-				stdinCapture.Pause(true)
+				// Pausing is meant for the input of up, not for a forked
+				// output, which is produced from that input anyway
+				forks.base(stdinCapture).Pause(true)
 				triggerRefresh(tui)
 			case key(tcell.KeyCtrlQ),
 				ctrlKey(tcell.KeyCtrlQ):
-				stdinCapture.Pause(false)
+				forks.base(stdinCapture).Pause(false)
+				restart = true
+			case altRune('+'),
+				altRune('='):
+				stdinCapture.Grow(*bufsize * 1024 * 1024)
 				restart = true
+				message = fmt.Sprintf("buffer limit raised to %d MiB", stdinCapture.Limit()/1024/1024)
+				if stdinCapture.Limit() == 0 {
+					message = "buffer has no limit"
+				}
 			case key(tcell.KeyCtrlC),
 				ctrlKey(tcell.KeyCtrlC),
 				key(tcell.KeyCtrlD),
 				ctrlKey(tcell.KeyCtrlD):
 				// Quit
 				tui.Fini()
+				commandPipeline.Kill()
+				forks.kill()
+				stopInput()
 				os.Stderr.WriteString("up: Ultimate Plumber v" + version + " https://github.com/akavel/up\n")
-				os.Stderr.WriteString("up: | " + commandEditor.String() + "\n")
+				os.Stderr.WriteString("up: | " + fullCommand() + "\n")
 				return
 			case key(tcell.KeyCtrlX),
 				ctrlKey(tcell.KeyCtrlX):
 				// Write script 'upN.sh' and quit
 				tui.Fini()
-				writeScript(shell, commandEditor.String(), tui)
+				commandPipeline.Kill()
+				forks.kill()
+				stopInput()
+				script.Shell, script.Command = shell, fullCommand()
+				writeScript(script, tui)
 				return
 			}
 		}
@@ -335,6 +878,82 @@ func triggerRefresh(tui tcell.Screen) {
 	tui.PostEvent(tcell.NewEventInterrupt(nil))
 }
 
+// refreshInterval is the minimum time between redraws caused by new data.
+const refreshInterval = 50 * time.Millisecond
+
+// Throttle calls a function at most once per interval. Calls made more often
+// are merged into one, postponed till the interval passes.
+type Throttle struct {
+	f        func()
+	interval time.Duration
+	// now and after are the clock used, replaceable in tests; after calls f
+	// in its own goroutine after d passes
+	now   func() time.Time
+	after func(d time.Duration, f func())
+
+	mu      sync.Mutex
+	last    time.Time // when f was last called
+	pending bool      // whether a postponed call of f is scheduled
+}
+
+func NewThrottle(interval time.Duration, f func()) *Throttle {
+	return &Throttle{
+		f:        f,
+		interval: interval,
+		now:      time.Now,
+		after:    func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+	}
+}
+
+// Call calls f, unless it was called less than the interval ago; then, f is
+// called when the interval passes.
+func (t *Throttle) Call() {
+	t.mu.Lock()
+	if t.pending {
+		t.mu.Unlock()
+		return
+	}
+	wait := t.interval - t.now().Sub(t.last)
+	if wait > 0 {
+		t.pending = true
+		t.mu.Unlock()
+		t.after(wait, func() {
+			t.mu.Lock()
+			t.pending, t.last = false, t.now()
+			t.mu.Unlock()
+			t.f()
+		})
+		return
+	}
+	t.last = t.now()
+	t.mu.Unlock()
+	t.f()
+}
+
+// argsCommand returns a shell command from command-line arguments. A single
+// argument is used as is, as it's most likely a pipeline quoted by user, while
+// multiple arguments are quoted for the shell where needed.
+func argsCommand(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes s for a POSIX shell, unless it's not needed.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 func die(message string) {
 	os.Stderr.WriteString("error: " + message + "\n")
 	os.Exit(1)
@@ -356,57 +975,101 @@ type Editor struct {
 	value     []rune
 	killspace []rune
 	cursor    int
-	// lastw is length of value on last Draw; we need it to know how much to erase after backspace
+	// lastw is length of prompt & value on last Draw; we need it to know how much to erase after backspace
 	lastw int
+
+	// History, if not nil, allows recalling earlier commands
+	History *History
+	// isearch is the query of an ongoing incremental reverse history search, or nil if none
+	isearch []rune
+	// isearchpos is the index of the History entry matched by the isearch query
+	isearchpos int
+	// isearchorig is the value from before the isearch started, for restoring it on cancel
+	isearchorig []rune
+
+	// undos and redos are stacks of states of the editor, from before the
+	// recent edits and from before the recent undos, respectively
+	undos, redos []editState
+	// lastEdit is the kind of the most recent edit, and lastCursor is the
+	// cursor position after it; used for grouping typed characters in undos
+	lastEdit   editKind
+	lastCursor int
 }
 
+type editState struct {
+	value  []rune
+	cursor int
+}
+
+type editKind int
+
+const (
+	editOther editKind = iota
+	editInsert
+)
+
 func (e *Editor) String() string { return string(e.value) }
 
 func (e *Editor) DrawTo(region Region, style tcell.Style, setcursor func(x, y int)) {
-	// Draw prompt & the edited value - use white letters on blue background
-	for i, ch := range e.prompt {
-		region.SetCell(i, 0, style, ch)
-	}
-	for i, ch := range e.value {
-		region.SetCell(len(e.prompt)+i, 0, style, ch)
+	prompt := e.prompt
+	if e.isearch != nil {
+		prompt = []rune("(reverse-i-search)`" + string(e.isearch) + "': ")
+		if e.isearchpos < 0 {
+			prompt = append([]rune("(failed "), prompt[1:]...)
+		}
 	}
 
+	// Draw prompt & the edited value - use white letters on blue background
+	x := drawRunes(region, 0, style, prompt)
+	end := drawRunes(region, x, style, e.value)
+
 	// Clear remains of last value if needed
-	for i := len(e.value); i < e.lastw; i++ {
-		region.SetCell(len(e.prompt)+i, 0, tcell.StyleDefault, ' ')
+	for i := end; i < e.lastw; i++ {
+		region.SetCell(i, 0, tcell.StyleDefault, ' ')
 	}
-	e.lastw = len(e.value)
+	e.lastw = end
 
 	// Show cursor if requested
 	if setcursor != nil {
-		setcursor(len(e.prompt)+e.cursor, 0)
+		setcursor(x+runesWidth(e.value[:e.cursor]), 0)
 	}
 }
 
 func (e *Editor) HandleKey(ev *tcell.EventKey) bool {
+	if e.isearch != nil && e.handleSearchKey(ev) {
+		return true
+	}
 	// If a character is entered, with no modifiers except maybe shift, then just insert it
 	if ev.Key() == tcell.KeyRune && ev.Modifiers()&(^tcell.ModShift) == 0 {
-		e.insert(ev.Rune())
+		e.edit(editInsert, func() { e.insert(ev.Rune()) })
 		return true
 	}
 	// Handle editing & movement keys
 	switch getKey(ev) {
 	case key(tcell.KeyBackspace), key(tcell.KeyBackspace2):
 		// See https://github.com/nsf/termbox-go/issues/145
-		e.delete(-1)
+		e.edit(editOther, func() { e.delete(-1) })
 	case key(tcell.KeyDelete):
-		e.delete(0)
+		e.edit(editOther, func() { e.delete(0) })
 	case key(tcell.KeyLeft),
 		key(tcell.KeyCtrlB),
 		ctrlKey(tcell.KeyCtrlB):
-		if e.cursor > 0 {
-			e.cursor--
+		// Move by whole cells, together with any combining characters
+		pos := 0
+		for pos < e.cursor {
+			n, _ := nextCell(e.value[pos:])
+			if pos+n >= e.cursor {
+				break
+			}
+			pos += n
 		}
+		e.cursor = pos
 	case key(tcell.KeyRight),
 		key(tcell.KeyCtrlF),
 		ctrlKey(tcell.KeyCtrlF):
 		if e.cursor < len(e.value) {
-			e.cursor++
+			n, _ := nextCell(e.value[e.cursor:])
+			e.cursor += n
 		}
 	case key(tcell.KeyCtrlA),
 		ctrlKey(tcell.KeyCtrlA):
@@ -416,13 +1079,38 @@ func (e *Editor) HandleKey(ev *tcell.EventKey) bool {
 		e.cursor = len(e.value)
 	case key(tcell.KeyCtrlK),
 		ctrlKey(tcell.KeyCtrlK):
-		e.kill()
+		e.edit(editOther, e.kill)
 	case key(tcell.KeyCtrlY),
 		ctrlKey(tcell.KeyCtrlY):
-		e.insert(e.killspace...)
+		e.edit(editOther, func() { e.insert(e.killspace...) })
 	case key(tcell.KeyCtrlW),
 		ctrlKey(tcell.KeyCtrlW):
-		e.unixWordRubout()
+		e.edit(editOther, e.unixWordRubout)
+	case key(tcell.KeyCtrlZ),
+		ctrlKey(tcell.KeyCtrlZ),
+		key(tcell.KeyCtrlUnderscore),
+		ctrlKey(tcell.KeyCtrlUnderscore):
+		e.undo()
+	case key(tcell.ModCtrl|tcell.ModShift)<<16 + key(tcell.KeyCtrlZ),
+		altRune('z'):
+		e.redo()
+	case key(tcell.KeyCtrlP),
+		ctrlKey(tcell.KeyCtrlP):
+		if e.History != nil {
+			e.edit(editOther, func() { e.set(e.History.Prev(e.String())) })
+		}
+	case key(tcell.KeyCtrlN),
+		ctrlKey(tcell.KeyCtrlN):
+		if e.History != nil {
+			e.edit(editOther, func() { e.set(e.History.Next()) })
+		}
+	case key(tcell.KeyCtrlR),
+		ctrlKey(tcell.KeyCtrlR):
+		if e.History != nil {
+			e.isearch = []rune{}
+			e.isearchpos = e.History.pos
+			e.isearchorig = append([]rune(nil), e.value...)
+		}
 	default:
 		// Unknown key/combination, not handled
 		return false
@@ -430,6 +1118,107 @@ func (e *Editor) HandleKey(ev *tcell.EventKey) bool {
 	return true
 }
 
+// handleSearchKey handles keys during incremental reverse history search, in
+// a way similar to readline. If the key is not a part of the search, the search
+// is finished, keeping the found command in the editor, and false is returned
+// so that the key can be processed further.
+func (e *Editor) handleSearchKey(ev *tcell.EventKey) bool {
+	if ev.Key() == tcell.KeyRune && ev.Modifiers()&(^tcell.ModShift) == 0 {
+		e.isearch = append(e.isearch, ev.Rune())
+		e.isearchNext(e.isearchpos)
+		return true
+	}
+	switch getKey(ev) {
+	case key(tcell.KeyBackspace), key(tcell.KeyBackspace2):
+		if len(e.isearch) > 0 {
+			e.isearch = e.isearch[:len(e.isearch)-1]
+			e.isearchNext(e.History.pos)
+		}
+	case key(tcell.KeyCtrlR),
+		ctrlKey(tcell.KeyCtrlR):
+		if e.isearchpos > 0 {
+			e.isearchNext(e.isearchpos - 1)
+		}
+	case key(tcell.KeyCtrlG),
+		ctrlKey(tcell.KeyCtrlG),
+		key(tcell.KeyEscape):
+		e.set(string(e.isearchorig))
+		e.isearch = nil
+	default:
+		if e.isearchpos >= 0 && e.isearchpos < len(e.History.entries) {
+			e.History.pos = e.isearchpos
+		}
+		if string(e.value) != string(e.isearchorig) {
+			e.undos = append(e.undos, editState{e.isearchorig, len(e.isearchorig)})
+			e.redos = e.redos[:0]
+			e.lastEdit = editOther
+		}
+		e.isearch = nil
+		return false
+	}
+	return true
+}
+
+// isearchNext finds the isearch query in History, starting at entry with
+// index from and moving towards older entries.
+func (e *Editor) isearchNext(from int) {
+	e.isearchpos = e.History.Search(string(e.isearch), from)
+	if e.isearchpos < 0 {
+		return
+	}
+	match := e.History.entries[e.isearchpos]
+	e.set(match)
+	e.cursor = len([]rune(match[:strings.Index(match, string(e.isearch))]))
+}
+
+// edit runs f, which is expected to modify the edited value, and if it was
+// indeed modified, saves the previous state for undo. Consecutive inserts of
+// characters are grouped into a single undo step, up to a word boundary.
+func (e *Editor) edit(kind editKind, f func()) {
+	before := editState{append([]rune(nil), e.value...), e.cursor}
+	f()
+	if string(before.value) == string(e.value) {
+		return
+	}
+	e.redos = e.redos[:0]
+	grouped := kind == editInsert && e.lastEdit == editInsert && before.cursor == e.lastCursor &&
+		!(before.cursor > 0 && unicode.IsSpace(before.value[before.cursor-1]))
+	if !grouped {
+		e.undos = append(e.undos, before)
+	}
+	e.lastEdit, e.lastCursor = kind, e.cursor
+}
+
+// undo restores the state of the editor from before the last edit.
+func (e *Editor) undo() {
+	if len(e.undos) == 0 {
+		return
+	}
+	e.redos = append(e.redos, editState{e.value, e.cursor})
+	last := e.undos[len(e.undos)-1]
+	e.undos = e.undos[:len(e.undos)-1]
+	e.value, e.cursor = last.value, last.cursor
+	e.lastEdit = editOther
+}
+
+// redo reverts the last undo.
+func (e *Editor) redo() {
+	if len(e.redos) == 0 {
+		return
+	}
+	e.undos = append(e.undos, editState{e.value, e.cursor})
+	last := e.redos[len(e.redos)-1]
+	e.redos = e.redos[:len(e.redos)-1]
+	e.value, e.cursor = last.value, last.cursor
+	e.lastEdit = editOther
+}
+
+// set replaces the edited value, moving the cursor to its end.
+func (e *Editor) set(value string) {
+	e.value = []rune(value)
+	e.cursor = len(e.value)
+}
+
 func (e *Editor) insert(ch ...rune) {
 	// Based on https://github.com/golang/go/wiki/SliceTricks#insert
 	e.value = append(e.value, ch...)                     // = PREFIX + SUFFIX + (filler)
@@ -438,13 +1227,23 @@ func (e *Editor) insert(ch ...rune) {
 	e.cursor += len(ch)
 }
 
+// delete removes the whole screen cell (a character together with any
+// combining characters) before the cursor if dx is -1, or at the cursor if dx
+// is 0.
 func (e *Editor) delete(dx int) {
 	pos := e.cursor + dx
 	if pos < 0 || pos >= len(e.value) {
 		return
 	}
-	e.value = append(e.value[:pos], e.value[pos+1:]...)
-	e.cursor = pos
+	// Combining characters can't be recognized backwards, so find the cell
+	// containing pos scanning from the start
+	start, end := 0, 0
+	for end <= pos {
+		n, _ := nextCell(e.value[end:])
+		start, end = end, end+n
+	}
+	e.value = append(e.value[:start], e.value[end:]...)
+	e.cursor = start
 }
 
 func (e *Editor) kill() {
@@ -470,87 +1269,344 @@ func (e *Editor) unixWordRubout() {
 	e.cursor = pos
 }
 
+// History is a list of commands executed earlier, persisted in a file.
+type History struct {
+	entries []string
+	path    string
+	// pos is the index of the entry currently recalled in the editor; if
+	// equal to len(entries), the user is editing a new command
+	pos int
+	// draft is the new command being edited before user started recalling entries
+	draft string
+}
+
+// historySize is the maximum number of entries kept in History
+const historySize = 1000
+
+// LoadHistory reads History from a file at path (if it exists), which will
+// also be used for storing new entries. If path is empty, History is not
+// persisted. The returned History is usable even if an error is returned.
+func LoadHistory(path string) (*History, error) {
+	h := &History{path: path}
+	if path == "" {
+		return h, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return h, fmt.Errorf("cannot read history: %s", err)
+	}
+	err = nil
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+	if len(h.entries) > historySize {
+		// Trim the history file, so that it doesn't grow indefinitely
+		h.entries = h.entries[len(h.entries)-historySize:]
+		err = ioutil.WriteFile(path, []byte(strings.Join(h.entries, "\n")+"\n"), 0600)
+		if err != nil {
+			err = fmt.Errorf("cannot trim history: %s", err)
+		}
+	}
+	h.pos = len(h.entries)
+	return h, err
+}
+
+// Add appends command to the History, unless it's empty or the same as the
+// last entry, and resets the recall position. An error is returned if the
+// command couldn't be saved in the file.
+func (h *History) Add(command string) error {
+	defer func() { h.pos = len(h.entries) }()
+	if strings.TrimSpace(command) == "" || strings.ContainsRune(command, '\n') ||
+		(len(h.entries) > 0 && h.entries[len(h.entries)-1] == command) {
+		return nil
+	}
+	h.entries = append(h.entries, command)
+	if h.path == "" {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(h.path), 0700)
+	if err != nil {
+		return fmt.Errorf("cannot save history: %s", err)
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot save history: %s", err)
+	}
+	_, err = f.WriteString(command + "\n")
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return fmt.Errorf("cannot save history: %s", err)
+	}
+	return nil
+}
+
+// Prev returns the entry older than the currently recalled one. If user
+// wasn't recalling any entry yet, current command is remembered as draft.
+func (h *History) Prev(current string) string {
+	if h.pos == len(h.entries) {
+		h.draft = current
+	}
+	if h.pos == 0 {
+		return current
+	}
+	h.pos--
+	return h.entries[h.pos]
+}
+
+// Next returns the entry newer than the currently recalled one, or the draft
+// if there's none.
+func (h *History) Next() string {
+	if h.pos < len(h.entries) {
+		h.pos++
+	}
+	if h.pos == len(h.entries) {
+		return h.draft
+	}
+	return h.entries[h.pos]
+}
+
+// Search returns the index of the newest entry containing query, starting
+// from entry with index from (inclusive) and moving towards older entries. If
+// no entry matches, -1 is returned.
+func (h *History) Search(query string, from int) int {
+	if from >= len(h.entries) {
+		from = len(h.entries) - 1
+	}
+	for i := from; i >= 0; i-- {
+		if strings.Contains(h.entries[i], query) {
+			return i
+		}
+	}
+	return -1
+}
+
+// defaultHistoryPath returns the path where History is stored by default,
+// following the XDG Base Directory Specification.
+func defaultHistoryPath() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "up", "history")
+}
+
 type BufView struct {
-	// TODO: Wrap bool
 	Y   int // Y of the view in the Buf, for down/up scrolling
 	X   int // X of the view in the Buf, for left/right scrolling
 	Buf *Buf
+	// Wrap makes lines longer than the view continue in the following rows;
+	// Y is still counted in lines of the Buf, not in rows of the view
+	Wrap bool
+	// width & fullLines are the width of the view, and the number of lines
+	// fully shown in it, at the last DrawTo
+	width, fullLines int
+	// Follow makes the view keep showing the last lines of the Buf as it grows
+	Follow bool
+	// Search, if not nil, is highlighted in the displayed text
+	Search *regexp.Regexp
 }
 
-func (v *BufView) DrawTo(region Region) {
-	r := bufio.NewReader(v.Buf.NewReader(false))
+// DrawStatus shows 'F' if the view is in follow mode.
+func (v *BufView) DrawStatus(region Region, style tcell.Style) {
+	status := ' '
+	if v.Follow {
+		status = 'F'
+	}
+	region.SetCell(0, 0, style, status)
+}
 
-	// PgDn/PgUp etc. support
-	for y := v.Y; y > 0; y-- {
-		line, err := r.ReadBytes('\n')
-		switch err {
-		case nil:
-			// skip line
-			continue
-		case io.EOF:
-			r = bufio.NewReader(bytes.NewReader(line))
-			y = 0
-			break
-		default:
-			panic(err)
+// DrawPosition shows the number of the top line of the view, and the total
+// number of lines, in the top-right corner of the region. Nothing is shown if
+// all lines fit in the region.
+func (v *BufView) DrawPosition(region Region, style tcell.Style) {
+	nlines := v.Buf.textLines()
+	if v.Y == 0 && v.fullLines >= nlines {
+		return
+	}
+	text := []rune(fmt.Sprintf(" line %d/%d ", v.Y+1, nlines))
+	drawRunes(region, region.W-len(text), style, text)
+}
+
+// bottomY returns the Y at which the last line of the Buf is shown at the
+// bottom of a view of height h. A newline at the end of the Buf is not
+// considered to start an empty last line.
+func (v *BufView) bottomY(h int) int {
+	nlines := v.Buf.textLines()
+	if v.Wrap && v.width > 1 {
+		// Count rows taken by lines, starting from the last one
+		rows := 0
+		for y := nlines - 1; y >= 0; y-- {
+			rows += v.wrappedRows(y, v.width)
+			if rows > h {
+				if y+1 < nlines {
+					return y + 1
+				}
+				return y
+			}
 		}
+		return 0
+	}
+	if nlines < h {
+		return 0
+	}
+	return nlines - h
+}
+
+func (v *BufView) DrawTo(region Region) {
+	v.width = region.W
+	if v.Follow {
+		v.Y = v.bottomY(region.H)
 	}
+	scrollX := v.X
+	if v.Wrap {
+		scrollX = 0
+	}
+
+	// PgDn/PgUp etc. support
+	r := bufio.NewReader(v.Buf.NewReaderAt(v.Buf.LineOffset(v.Y), false))
 
 	lclip := false
-	drawch := func(x, y int, ch rune) {
-		if x <= v.X && v.X != 0 {
-			x, ch = 0, '«'
+	rwide := false // whether a wide character was drawn in the last column
+	drawch := func(x, y int, style tcell.Style, width int, ch ...rune) {
+		if x <= scrollX && scrollX != 0 {
+			// Also clear the part of a wide character sticking out of '«'
+			for i := 1; i < x+width-scrollX; i++ {
+				region.SetCell(i, y, style, ' ')
+			}
+			x, ch = 0, []rune{'«'}
 			lclip = true
 		} else {
-			x -= v.X
+			x -= scrollX
 		}
-		if x >= region.W {
-			x, ch = region.W-1, '»'
+		switch {
+		case x+width > region.W:
+			if rwide {
+				// Make room for '»' in place of a wide character
+				region.SetCell(region.W-2, y, style, ' ')
+				rwide = false
+			}
+			x, ch = region.W-1, []rune{'»'}
+		case x+width == region.W && width > 1:
+			rwide = true
 		}
-		region.SetCell(x, y, tcell.StyleDefault, ch)
+		region.SetCell(x, y, style, ch...)
 	}
 	endline := func(x, y int) {
-		x -= v.X
+		x -= scrollX
 		if x < 0 {
 			x = 0
 		}
 		if x == 0 && lclip {
 			x++
 		}
-		lclip = false
+		lclip, rwide = false, false
 		for ; x < region.W; x++ {
 			region.SetCell(x, y, tcell.StyleDefault, ' ')
 		}
 	}
 
 	x, y := 0, 0
-	// TODO: handle runes properly, including their visual width (mattn/go-runewidth)
-	for {
-		ch, _, err := r.ReadRune()
-		if y >= region.H || err == io.EOF {
-			break
-		} else if err != nil {
-			panic(err)
+	// In Wrap mode, a cell which doesn't fit in the row before the last
+	// column is moved to the next row, and a '\\' continuation marker is
+	// drawn in the last column, like in Emacs
+	fits := func(width int) bool {
+		if !v.Wrap || x+width <= region.W-1 {
+			return true
 		}
-		switch ch {
-		case '\n':
-			endline(x, y)
-			x, y = 0, y+1
-			continue
-		case '\t':
-			const tabwidth = 8
-			drawch(x, y, ' ')
-			for x%tabwidth < (tabwidth - 1) {
-				x++
-				if x >= region.W {
+		endline(x, y)
+		region.SetCell(region.W-1, y, tcell.StyleDefault, '\\')
+		x, y = 0, y+1
+		return y < region.H
+	}
+	v.fullLines = 0
+	sgr := tcell.StyleDefault // style set by ANSI escape sequences
+	// The most recently drawn cell, to which combining characters are added
+	var (
+		cell      []rune
+		cellX     int
+		cellWidth int
+		cellStyle tcell.Style
+	)
+	for y < region.H {
+		raw, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		var (
+			line    []byte
+			styles  []tcell.Style
+			matches [][]int
+		)
+		line, styles, sgr = decodeANSI(raw, sgr)
+		if v.Search != nil {
+			matches = v.Search.FindAllIndex(bytes.TrimSuffix(line, []byte{'\n'}), -1)
+		}
+		for i := 0; i < len(line) && y < region.H; {
+			ch, size := utf8.DecodeRune(line[i:])
+			style := sgr
+			if styles != nil {
+				style = styles[i]
+			}
+			// Highlight characters found by search
+			for len(matches) > 0 && matches[0][1] <= i {
+				matches = matches[1:]
+			}
+			if len(matches) > 0 && matches[0][0] <= i {
+				style = foundStyle
+			}
+			i += size
+			switch {
+			case ch == '\n':
+				endline(x, y)
+				x, y = 0, y+1
+				cell = nil
+				v.fullLines++
+			case ch == '\t':
+				if !fits(1) {
+					break
+				}
+				next := tabStop(x)
+				if v.Wrap && next > region.W-1 {
+					next = region.W - 1
+				}
+				for ; x < next; x++ {
+					drawch(x, y, style, 1, ' ')
+				}
+				cell = nil
+			case cell != nil && (combining(ch) || cell[len(cell)-1] == zwj):
+				cell = append(cell, ch)
+				drawch(cellX, y, cellStyle, cellWidth, cell...)
+			default:
+				width := runewidth.RuneWidth(ch)
+				if width < 1 {
+					width = 1
+				}
+				if !fits(width) {
 					break
 				}
-				drawch(x, y, ' ')
+				cell, cellX, cellWidth, cellStyle = []rune{ch}, x, width, style
+				if combining(ch) {
+					// Nothing to combine with, so show it on a space
+					cell = []rune{' ', ch}
+				}
+				drawch(x, y, style, cellWidth, cell...)
+				x += cellWidth
 			}
-		default:
-			drawch(x, y, ch)
 		}
-		x++
+		if err == io.EOF {
+			if y < region.H {
+				v.fullLines++
+			}
+			break
+		}
 	}
 	for ; y < region.H; y++ {
 		endline(x, y)
@@ -558,6 +1614,39 @@ func (v *BufView) DrawTo(region Region) {
 	}
 }
 
+// tabStop returns the column following a tab character at column x.
+func tabStop(x int) int {
+	const tabwidth = 8
+	return (x/tabwidth + 1) * tabwidth
+}
+
+// wrappedRows returns the number of rows taken by the y-th line of the Buf
+// in Wrap mode, in a view of the specified width.
+func (v *BufView) wrappedRows(y, width int) int {
+	raw, _ := bufio.NewReader(v.Buf.NewReaderAt(v.Buf.LineOffset(y), false)).ReadBytes('\n')
+	line, _, _ := decodeANSI(bytes.TrimSuffix(raw, []byte{'\n'}), tcell.StyleDefault)
+	text := []rune(string(line))
+	rows, x := 1, 0
+	for len(text) > 0 {
+		n, w := 1, 1
+		if text[0] != '\t' {
+			n, w = nextCell(text)
+		}
+		if x+w > width-1 {
+			rows, x = rows+1, 0
+		}
+		if text[0] == '\t' {
+			w = tabStop(x) - x
+			if x+w > width-1 {
+				w = width - 1 - x
+			}
+		}
+		x += w
+		text = text[n:]
+	}
+	return rows
+}
+
 func (v *BufView) HandleKey(ev *tcell.EventKey, scrollY int) bool {
 	const scrollX = 8 // When user scrolls horizontally, move by this many characters
 	switch getKey(ev) {
@@ -567,16 +1656,42 @@ func (v *BufView) HandleKey(ev *tcell.EventKey, scrollY int) bool {
 	case key(tcell.KeyUp):
 		v.Y--
 		v.normalizeY()
+		v.Follow = false
 	case key(tcell.KeyDown):
 		v.Y++
 		v.normalizeY()
+		// Scrolling to the bottom automatically enables follow mode
+		v.Follow = v.Y >= v.bottomY(scrollY)
 	case key(tcell.KeyPgDn):
-		// TODO: in top-right corner of Buf area, draw current line number & total # of lines
-		v.Y += scrollY
+		if v.Wrap {
+			// Lines may take multiple rows, so scroll by the lines which were
+			// fully visible
+			if v.fullLines > 1 {
+				v.Y += v.fullLines
+			} else {
+				v.Y++
+			}
+		} else {
+			v.Y += scrollY
+		}
 		v.normalizeY()
+		v.Follow = v.Y >= v.bottomY(scrollY)
 	case key(tcell.KeyPgUp):
 		v.Y -= scrollY
 		v.normalizeY()
+		v.Follow = false
+	case key(tcell.KeyHome),
+		altRune('g'):
+		v.Y = 0
+		v.Follow = false
+	case key(tcell.KeyEnd),
+		altRune('G'):
+		v.Y = v.bottomY(scrollY)
+		v.Follow = true
+	case altRune('t'):
+		v.Follow = !v.Follow
+	case altRune('w'):
+		v.Wrap = !v.Wrap
 	//
 	// Horizontal scrolling
 	//
@@ -599,8 +1714,304 @@ func (v *BufView) HandleKey(ev *tcell.EventKey, scrollY int) bool {
 	return true
 }
 
+// FindNext scrolls the view to the nearest line after (or before, if not
+// forward) the top one, where Search is found, and reports if it was found.
+// If needed, the view is also scrolled horizontally, so that the found text
+// is visible in width w.
+func (v *BufView) FindNext(forward bool, w int) bool {
+	if v.Search == nil {
+		return false
+	}
+	found := func(y int, line []byte) bool {
+		line, _, _ = decodeANSI(line, tcell.StyleDefault)
+		m := v.Search.FindIndex(bytes.TrimSuffix(line, []byte{'\n'}))
+		if m == nil {
+			return false
+		}
+		v.Y, v.Follow = y, false
+		if x := column(line[:m[0]]); x < v.X || x >= v.X+w-1 {
+			v.X = x - w/2
+			if v.X < 0 {
+				v.X = 0
+			}
+		}
+		return true
+	}
+	if forward {
+		r := bufio.NewReader(v.Buf.NewReaderAt(v.Buf.LineOffset(v.Y+1), false))
+		for y := v.Y + 1; y < v.Buf.Lines(); y++ {
+			line, err := r.ReadBytes('\n')
+			if found(y, line) {
+				return true
+			}
+			if err != nil {
+				break
+			}
+		}
+		return false
+	}
+	// Read each block of indexed lines forward just once, then search its
+	// lines from the last one
+	for end := v.Y - 1; end >= 0; {
+		start := end / lineIndexStep * lineIndexStep
+		r := bufio.NewReader(v.Buf.NewReaderAt(v.Buf.LineOffset(start), false))
+		lines := make([][]byte, 0, end-start+1)
+		for y := start; y <= end; y++ {
+			line, err := r.ReadBytes('\n')
+			lines = append(lines, line)
+			if err != nil {
+				break
+			}
+		}
+		for i := len(lines) - 1; i >= 0; i-- {
+			if found(start+i, lines[i]) {
+				return true
+			}
+		}
+		end = start - 1
+	}
+	return false
+}
+
+// decodeANSI removes escape sequences and other control characters (except
+// '\t' and '\n') from line, so that they can be safely displayed. The
+// remaining text is returned together with a style for each of its bytes, as
+// set by ANSI SGR escape sequences (e.g. colors emitted by `grep
+// --color=always`). The style in effect at the start of line must be passed as
+// style, and the one in effect at its end is returned as next. If line has no
+// escape sequences, nil styles are returned, meaning all bytes use style.
+func decodeANSI(line []byte, style tcell.Style) (text []byte, styles []tcell.Style, next tcell.Style) {
+	clean := true
+	for _, c := range line {
+		if c < 0x20 && c != '\t' && c != '\n' || c == 0x7f || c == 0xc2 {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return line, nil, style
+	}
+
+	text = make([]byte, 0, len(line))
+	styles = make([]tcell.Style, 0, len(line))
+	const esc = 0x1b
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == esc && i+1 < len(line) && line[i+1] == '[':
+			// CSI: ESC [ parameters... intermediates... final
+			j := i + 2
+			for j < len(line) && line[j] >= 0x30 && line[j] <= 0x3f {
+				j++
+			}
+			params := string(line[i+2 : j])
+			k := j
+			for k < len(line) && line[k] >= 0x20 && line[k] <= 0x2f {
+				k++
+			}
+			if k < len(line) && line[k] == 'm' && k == j {
+				style = applySGR(style, params)
+			}
+			i = k + 1
+		case c == esc && i+1 < len(line) && line[i+1] == ']':
+			// OSC: ESC ] ... terminated with BEL or ESC \
+			i += 2
+			for i < len(line) && line[i] != 0x07 && !(line[i] == esc && i+1 < len(line) && line[i+1] == '\\') {
+				i++
+			}
+			if i < len(line) && line[i] == esc {
+				i++
+			}
+			i++
+		case c == esc:
+			// Other: ESC intermediates... final
+			i++
+			for i < len(line) && line[i] >= 0x20 && line[i] <= 0x2f {
+				i++
+			}
+			i++
+		case c < 0x20 && c != '\t' && c != '\n' || c == 0x7f:
+			// Other C0 control characters
+			i++
+		case c == 0xc2 && i+1 < len(line) && line[i+1] >= 0x80 && line[i+1] <= 0x9f:
+			// C1 control characters, encoded in UTF-8
+			i += 2
+		default:
+			text = append(text, c)
+			styles = append(styles, style)
+			i++
+		}
+	}
+	return text, styles, style
+}
+
+// applySGR returns style modified according to parameters of an SGR (Select
+// Graphic Rendition) escape sequence, like "1;31" (bold red).
+func applySGR(style tcell.Style, params string) tcell.Style {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		args := strings.Split(codes[i], ":")
+		n, _ := strconv.Atoi(args[0])
+		switch {
+		case n == 0:
+			style = tcell.StyleDefault
+		case n == 1:
+			style = style.Bold(true)
+		case n == 2:
+			style = style.Dim(true)
+		case n == 3:
+			style = style.Italic(true)
+		case n == 4:
+			style = style.Underline(true)
+		case n == 5, n == 6:
+			style = style.Blink(true)
+		case n == 7:
+			style = style.Reverse(true)
+		case n == 22:
+			style = style.Bold(false).Dim(false)
+		case n == 23:
+			style = style.Italic(false)
+		case n == 24:
+			style = style.Underline(false)
+		case n == 25:
+			style = style.Blink(false)
+		case n == 27:
+			style = style.Reverse(false)
+		case n >= 30 && n <= 37:
+			style = style.Foreground(tcell.Color(n - 30))
+		case n == 39:
+			style = style.Foreground(tcell.ColorDefault)
+		case n >= 40 && n <= 47:
+			style = style.Background(tcell.Color(n - 40))
+		case n == 49:
+			style = style.Background(tcell.ColorDefault)
+		case n >= 90 && n <= 97:
+			style = style.Foreground(tcell.Color(n - 90 + 8))
+		case n >= 100 && n <= 107:
+			style = style.Background(tcell.Color(n - 100 + 8))
+		case n == 38, n == 48:
+			// Extended color, either as "38;5;N" or "38;2;R;G;B", or with
+			// colons as separators
+			var color tcell.Color
+			if len(args) > 1 {
+				color, _ = parseSGRColor(args[1:])
+			} else {
+				var used int
+				color, used = parseSGRColor(codes[i+1:])
+				i += used
+			}
+			if n == 38 {
+				style = style.Foreground(color)
+			} else {
+				style = style.Background(color)
+			}
+		}
+	}
+	return style
+}
+
+// parseSGRColor parses arguments of an extended color SGR parameter, returning
+// the color and the number of arguments used.
+func parseSGRColor(args []string) (tcell.Color, int) {
+	num := func(i int) int32 {
+		if i >= len(args) {
+			return 0
+		}
+		n, _ := strconv.Atoi(args[i])
+		return int32(n)
+	}
+	switch num(0) {
+	case 5:
+		return tcell.Color(num(1) & 0xff), 2
+	case 2:
+		if len(args) == 5 && args[1] == "" {
+			// Colon form with empty color space ID: "38:2::R:G:B"
+			return tcell.NewRGBColor(num(2), num(3), num(4)), 5
+		}
+		return tcell.NewRGBColor(num(1), num(2), num(3)), 4
+	}
+	return tcell.ColorDefault, 1
+}
+
+// column returns the screen column at which text following line would be
+// drawn by BufView.
+func column(line []byte) int {
+	x := 0
+	text := []rune(string(line))
+	for len(text) > 0 {
+		if text[0] == '\t' {
+			x = tabStop(x)
+			text = text[1:]
+			continue
+		}
+		n, w := nextCell(text)
+		x += w
+		text = text[n:]
+	}
+	return x
+}
+
+// zwj is the Zero Width Joiner, used e.g. to combine multiple emoji into one
+const zwj = '\u200d'
+
+// combining reports whether ch is drawn together with the preceding
+// character, in the same screen cell: like accents, variation selectors, or
+// other zero-width characters.
+func combining(ch rune) bool {
+	return ch == zwj ||
+		(ch >= '\ufe00' && ch <= '\ufe0f') ||
+		(unicode.IsPrint(ch) && runewidth.RuneWidth(ch) == 0)
+}
+
+// nextCell returns the number of characters at the start of text which are
+// displayed in a single screen cell, and the width of the cell in columns
+// (e.g. 2 for East Asian wide characters).
+func nextCell(text []rune) (n int, width int) {
+	if len(text) == 0 {
+		return 0, 0
+	}
+	n = 1
+	for n < len(text) && (combining(text[n]) || text[n-1] == zwj) {
+		n++
+	}
+	width = runewidth.RuneWidth(text[0])
+	if width < 1 {
+		width = 1
+	}
+	return n, width
+}
+
+// runesWidth returns the number of screen columns used for displaying text.
+func runesWidth(text []rune) int {
+	x := 0
+	for len(text) > 0 {
+		n, w := nextCell(text)
+		x += w
+		text = text[n:]
+	}
+	return x
+}
+
+// drawRunes draws text in the first row of region starting at column x,
+// handling wide and combining characters, and returns the column following the
+// text.
+func drawRunes(region Region, x int, style tcell.Style, text []rune) int {
+	for len(text) > 0 {
+		n, w := nextCell(text)
+		cell := text[:n]
+		if combining(cell[0]) {
+			// Nothing to combine with, so show it on a space
+			cell = append([]rune{' '}, cell...)
+		}
+		region.SetCell(x, 0, style, cell...)
+		x += w
+		text = text[n:]
+	}
+	return x
+}
+
 func (v *BufView) normalizeY() {
-	nlines := count(v.Buf.NewReader(false), '\n') + 1
+	nlines := v.Buf.Lines()
 	if v.Y >= nlines {
 		v.Y = nlines - 1
 	}
@@ -609,31 +2020,53 @@ func (v *BufView) normalizeY() {
 	}
 }
 
-func count(r io.Reader, b byte) (n int) {
-	buf := [256]byte{}
-	for {
-		i, err := r.Read(buf[:])
-		n += bytes.Count(buf[:i], []byte{b})
-		if err != nil {
-			return
-		}
-	}
-}
+// bufChunk is the size of segments in which data of a Buf is stored.
+const bufChunk = 64 * 1024
+
+// lineIndexStep is the number of lines between the offsets kept in the line
+// index of a Buf.
+const lineIndexStep = 256
 
-func NewBuf(bufsize int) *Buf {
-	// TODO: make buffer size dynamic (growable by pressing a key)
-	buf := &Buf{bytes: make([]byte, bufsize)}
+// NewBuf creates a buffer which will capture at most limit bytes, unless the
+// limit is later raised with Grow. A limit of 0 means the buffer can grow
+// without limits. Data above the --mem size is spilled to a temporary file.
+func NewBuf(limit int) *Buf {
+	buf := &Buf{
+		limit:   limit,
+		spillAt: *memsize * 1024 * 1024,
+	}
 	buf.cond = sync.NewCond(&buf.mu)
 	return buf
 }
 
 type Buf struct {
-	bytes []byte
-
 	mu     sync.Mutex // guards the following fields
 	cond   *sync.Cond
 	status bufStatus
 	n      int
+	limit  int
+	// chunks keep the captured data in segments of bufChunk bytes. Captured
+	// bytes are never modified, and the segments are never reallocated, so
+	// the segments may be accessed by readers without holding the lock.
+	chunks [][]byte
+	// spill keeps the captured data which didn't fit in memory, i.e. above
+	// spillAt bytes (if non-zero). The file is unlinked immediately after
+	// creation, so that it gets removed by OS however we exit; it is closed
+	// by the finalizer of os.File when no longer used. Where open files can't
+	// be unlinked (Windows), it's removed by removeSpillFiles instead. Similar to chunks,
+	// spill can be read without holding the lock, using ReadAt.
+	spill   *os.File
+	spillAt int
+	// err is set if capturing failed, e.g. because writing to spill failed
+	err error
+	// nlines is the number of '\n' bytes in the captured data
+	nlines int
+	// lineIndex keeps offsets where every lineIndexStep-th line starts (i.e.
+	// lineIndex[k] is the start of line (k+1)*lineIndexStep), for quickly
+	// finding where a line starts, without keeping all offsets in memory
+	lineIndex []int
+	// closed is set by Close, to stop capturing
+	closed bool
 }
 
 type bufStatus int
@@ -650,28 +2083,78 @@ func (b *Buf) StartCapturing(r io.Reader, notify func()) *Buf {
 }
 
 func (b *Buf) capture(r io.Reader, notify func()) {
-	// TODO: allow stopping - take context?
+	var scratch []byte // for reading data to be spilled to disk
 	for {
-		n, err := r.Read(b.bytes[b.n:])
+		b.mu.Lock()
+		// If the buffer is full, don't read more input until it's grown
+		for b.full() && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			b.stopCapturing(r)
+			b.mu.Unlock()
+			go notify()
+			return
+		}
+		// Find some free space at the end of the buffer
+		inMemory := b.spill == nil && (b.spillAt == 0 || b.n < b.spillAt || b.n < len(b.chunks)*bufChunk)
+		if inMemory && b.n == len(b.chunks)*bufChunk {
+			b.chunks = append(b.chunks, make([]byte, bufChunk))
+		}
+		var free []byte
+		if inMemory {
+			free = b.chunks[len(b.chunks)-1][b.n%bufChunk:]
+		} else {
+			if scratch == nil {
+				scratch = make([]byte, bufChunk)
+			}
+			free = scratch
+		}
+		if b.limit > 0 && len(free) > b.limit-b.n {
+			free = free[:b.limit-b.n]
+		}
+		b.mu.Unlock()
+
+		n, err := r.Read(free)
+		nlines, lineIndex := indexLines(free[:n], b.n, b.nlines)
+		if !inMemory && n > 0 {
+			if spillErr := b.spillData(free[:n]); spillErr != nil {
+				// Nothing more can be stored, so stop, and tell user why
+				log.Printf("cannot spill data to disk: %s", spillErr)
+				b.mu.Lock()
+				b.err = fmt.Errorf("cannot spill data to disk: %s", spillErr)
+				b.stopCapturing(r)
+				b.mu.Unlock()
+				go notify()
+				return
+			}
+		}
 
 		b.mu.Lock()
-		for b.status == bufPaused {
+		for b.status == bufPaused && !b.closed {
 			b.cond.Wait()
 		}
 		b.n += n
+		b.nlines = nlines
+		b.lineIndex = append(b.lineIndex, lineIndex...)
 		if err == io.EOF {
 			b.status = bufEOF
 		}
-		if b.n == len(b.bytes) {
-			// TODO: remove this when we can grow the buffer
-			err = io.EOF
+		closed := b.closed
+		if closed && err != io.EOF {
+			b.stopCapturing(r)
 		}
 		b.cond.Broadcast()
 		b.mu.Unlock()
 
+		if closed && err != io.EOF {
+			go notify()
+			return
+		}
+
 		go notify()
 		if err == io.EOF {
-			log.Printf("capture EOF after: %q", b.bytes[:b.n]) // TODO: make sure no race here, and skipped if not debugging
+			log.Printf("capture EOF after %d bytes", b.n) // TODO: make sure no race here, and skipped if not debugging
 			return
 		} else if err != nil {
 			// TODO: better handling of errors
@@ -680,6 +2163,182 @@ func (b *Buf) capture(r io.Reader, notify func()) {
 	}
 }
 
+// stopCapturing marks the buffer as complete, and closes r (if possible), so
+// that whoever writes to it is not blocked forever. It must be called with
+// b.mu held.
+func (b *Buf) stopCapturing(r io.Reader) {
+	b.status = bufEOF
+	b.cond.Broadcast()
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// Close stops capturing data into the buffer, even if it's waiting until the
+// buffer is grown or unpaused. The data captured so far is kept.
+func (b *Buf) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// indexLines counts '\n' bytes in data, assuming data starts at the specified
+// offset, and nlines newlines precede it. It returns the new count of newlines,
+// and the entries to be appended to the line index of a Buf.
+func indexLines(data []byte, offset, nlines int) (int, []int) {
+	var lineIndex []int
+	for i := 0; ; {
+		j := bytes.IndexByte(data[i:], '\n')
+		if j == -1 {
+			return nlines, lineIndex
+		}
+		nlines++
+		if nlines%lineIndexStep == 0 {
+			lineIndex = append(lineIndex, offset+i+j+1)
+		}
+		i += j + 1
+	}
+}
+
+// Size returns the number of bytes captured so far.
+func (b *Buf) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// Lines returns the number of lines in the captured data, including the
+// (potentially empty) last one which is not terminated with a newline.
+func (b *Buf) Lines() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nlines + 1
+}
+
+// textLines returns the number of lines in the captured data, not counting an
+// empty last line after a newline at the end of the data.
+func (b *Buf) textLines() int {
+	nlines := b.Lines()
+	if b.LineOffset(nlines-1) == b.Size() {
+		nlines--
+	}
+	return nlines
+}
+
+// LineOffset returns the offset of the start of the y-th line (counting from
+// 0) in the captured data. If y is bigger than the number of lines, the start
+// of the last line is returned.
+func (b *Buf) LineOffset(y int) int {
+	b.mu.Lock()
+	if y > b.nlines {
+		y = b.nlines
+	}
+	if y <= 0 {
+		b.mu.Unlock()
+		return 0
+	}
+	// Start from the nearest indexed line, then scan forward for the rest
+	offset, skip := 0, y
+	if k := y / lineIndexStep; k > 0 {
+		offset, skip = b.lineIndex[k-1], y-k*lineIndexStep
+	}
+	b.mu.Unlock()
+
+	r := b.NewReaderAt(offset, false)
+	buf := make([]byte, 4096)
+	for skip > 0 {
+		n, err := r.Read(buf)
+		for i := 0; ; {
+			j := bytes.IndexByte(buf[i:n], '\n')
+			if j == -1 {
+				break
+			}
+			i += j + 1
+			if skip--; skip == 0 {
+				return offset + i
+			}
+		}
+		offset += n
+		if err != nil {
+			break
+		}
+	}
+	return offset
+}
+
+// spillData writes data to the spill file (creating it if needed) at the end
+// of the captured data. It must be called only from the capture goroutine.
+func (b *Buf) spillData(data []byte) error {
+	b.mu.Lock()
+	spill, off := b.spill, b.n-len(b.chunks)*bufChunk
+	b.mu.Unlock()
+	if spill == nil {
+		f, err := ioutil.TempFile("", "up-spill-*")
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			// Open files can't be removed on Windows
+			spillFiles.Lock()
+			spillFiles.files = append(spillFiles.files, f)
+			spillFiles.Unlock()
+		}
+		spill = f
+	}
+	_, err := spill.WriteAt(data, int64(off))
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.spill = spill
+	b.mu.Unlock()
+	return nil
+}
+
+// spillFiles keeps spill files which couldn't be removed while open, to
+// remove them in removeSpillFiles.
+var spillFiles struct {
+	sync.Mutex
+	files []*os.File
+}
+
+// removeSpillFiles removes spill files which couldn't be removed when they
+// were created. It must be called before up exits.
+func removeSpillFiles() {
+	spillFiles.Lock()
+	defer spillFiles.Unlock()
+	for _, f := range spillFiles.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	spillFiles.files = nil
+}
+
+// full reports whether the limit of the buffer was reached. It must be called
+// with b.mu held.
+func (b *Buf) full() bool {
+	return b.limit > 0 && b.n >= b.limit
+}
+
+// Grow raises the limit of the buffer by extra bytes, resuming capturing if
+// it was stopped because the buffer was full.
+func (b *Buf) Grow(extra int) {
+	b.mu.Lock()
+	if b.limit > 0 {
+		b.limit += extra
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// Limit returns the current limit of the buffer size.
+func (b *Buf) Limit() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit
+}
+
 func (b *Buf) Pause(pause bool) {
 	b.mu.Lock()
 	if pause {
@@ -698,6 +2357,23 @@ func (b *Buf) Pause(pause bool) {
 	b.mu.Unlock()
 }
 
+// Snapshot returns a frozen copy of the data captured in b so far. As the
+// captured data is never modified, the bytes are shared, not copied.
+func (b *Buf) Snapshot() *Buf {
+	b.mu.Lock()
+	snap := &Buf{
+		status:    bufEOF,
+		n:         b.n,
+		chunks:    b.chunks,
+		spill:     b.spill,
+		nlines:    b.nlines,
+		lineIndex: b.lineIndex[:len(b.lineIndex):len(b.lineIndex)],
+	}
+	b.mu.Unlock()
+	snap.cond = sync.NewCond(&snap.mu)
+	return snap
+}
+
 func (b *Buf) DrawStatus(region Region, style tcell.Style) {
 	status := '~' // default: still reading input
 
@@ -707,7 +2383,7 @@ func (b *Buf) DrawStatus(region Region, style tcell.Style) {
 		status = '#'
 	case b.status == bufEOF:
 		status = ' ' // all input read, nothing more to do
-	case b.n == len(b.bytes):
+	case b.full():
 		status = '+' // buffer full
 	}
 	b.mu.Unlock()
@@ -715,27 +2391,67 @@ func (b *Buf) DrawStatus(region Region, style tcell.Style) {
 	region.SetCell(0, 0, style, status)
 }
 
+// State describes in words whether the buffer is still capturing data.
+func (b *Buf) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.err != nil:
+		return "truncated"
+	case b.status == bufPaused:
+		return "paused"
+	case b.status == bufEOF:
+		return "complete"
+	case b.full():
+		return "full"
+	}
+	return "reading"
+}
+
+// Err returns the error which stopped capturing data, if any.
+func (b *Buf) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
 func (b *Buf) NewReader(blocking bool) io.Reader {
-	i := 0
+	return b.NewReaderAt(0, blocking)
+}
+
+// NewReaderAt returns a reader of the captured data starting at offset.
+func (b *Buf) NewReaderAt(offset int, blocking bool) io.Reader {
+	i := offset
 	return funcReader(func(p []byte) (n int, err error) {
 		b.mu.Lock()
 		end := b.n
-		for blocking && end == i && b.status == bufReading && end < len(b.bytes) {
+		for blocking && end == i && b.status == bufReading && !b.full() {
 			b.cond.Wait()
 			end = b.n
 		}
+		chunks, spill := b.chunks, b.spill
 		b.mu.Unlock()
 
-		n = copy(p, b.bytes[i:end])
-		i += n
-		if n > 0 {
-			return n, nil
-		} else {
+		if i == end {
 			if blocking {
-				log.Printf("blocking reader emitting EOF after: %q", b.bytes[:end])
+				log.Printf("blocking reader emitting EOF after %d bytes", end)
 			}
 			return 0, io.EOF
 		}
+		if len(p) > end-i {
+			p = p[:end-i]
+		}
+		if inMemory := len(chunks) * bufChunk; i >= inMemory {
+			n, err = spill.ReadAt(p, int64(i-inMemory))
+			i += n
+			if n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+		n = copy(p, chunks[i/bufChunk][i%bufChunk:])
+		i += n
+		return n, nil
 	})
 }
 
@@ -744,60 +2460,1318 @@ type funcReader func([]byte) (int, error)
 func (f funcReader) Read(p []byte) (int, error) { return f(p) }
 
 type Subprocess struct {
-	Buf    *Buf
-	cancel context.CancelFunc
+	Buf     *Buf
+	process *os.Process   // nil if the process failed to start
+	done    chan struct{} // closed when the process finishes
+	err     error         // result of the process; valid after done is closed
+	started time.Time
+	ended   time.Time // valid after done is closed
+
+	killOnce  sync.Once
+	killed    chan struct{} // closed when Kill is called
+	escalated chan struct{} // closed when SIGKILL is sent, after Kill
+
+	// mu guards reaped, which is set when the process group can't be
+	// signalled anymore, as its ID may be reused
+	mu     sync.Mutex
+	reaped bool
+}
+
+// killGrace is how long processes get to exit after SIGTERM, before they are
+// killed with SIGKILL.
+const killGrace = 500 * time.Millisecond
+
+// StartSubprocess runs command in shell, reading from stdin. The standard
+// output of the command is captured in the returned Subprocess's Buf, while
+// its error messages are written to stderr.
+func StartSubprocess(shell []string, command string, stdin *Buf, stderr io.Writer, notify func()) *Subprocess {
+	cmd := exec.Command(shell[0], append(shell[1:], command)...)
+	if confine != nil {
+		confine(cmd)
+	}
+	return startProcess(cmd, stdin.NewReader(true), NewBuf(stdin.Limit()), stderr, *timeout, notify)
+}
+
+// StartInput runs command in shell, capturing its standard output and error
+// messages (like with '|&') in buf, to be used as input of the pipeline. As
+// the command is not typed interactively, it is run without --sandbox, limits
+// and --timeout.
+func StartInput(shell []string, command string, buf *Buf, notify func()) *Subprocess {
+	cmd := exec.Command(shell[0], append(shell[1:], command)...)
+	return startProcess(cmd, nil, buf, nil, 0, notify)
 }
 
-func StartSubprocess(shell []string, command string, stdin *Buf, notify func()) *Subprocess {
-	ctx, cancel := context.WithCancel(context.TODO())
-	r, w := io.Pipe()
+// startProcess starts cmd in a new process group, feeding it with stdin (if
+// not nil), capturing its standard output in buf, and writing its error
+// messages to stderr, or to buf if stderr is nil. The process is killed if it
+// runs longer than maxTime, unless it's 0.
+func startProcess(cmd *exec.Cmd, stdin io.Reader, buf *Buf, stderr io.Writer, maxTime time.Duration, notify func()) *Subprocess {
 	p := &Subprocess{
-		Buf:    NewBuf(len(stdin.bytes)).StartCapturing(r, notify),
-		cancel: cancel,
+		Buf:       buf,
+		done:      make(chan struct{}),
+		killed:    make(chan struct{}),
+		escalated: make(chan struct{}),
+		started:   time.Now(),
+	}
+	fail := func(err error) *Subprocess {
+		if stderr != nil {
+			fmt.Fprintf(stderr, "up: %s\n", err)
+		}
+		p.err = err
+		p.ended = p.started
+		close(p.done)
+		return p
+	}
+
+	// The pipes are created here, and not by cmd, so that cmd.Wait returns as
+	// soon as the process exits. Otherwise it would also wait until all input
+	// is copied to the process, which may never happen, e.g. with input from
+	// `tail -f`, or until its children close the output.
+	r, w, err := os.Pipe()
+	if err != nil {
+		buf.StartCapturing(strings.NewReader(""), notify)
+		return fail(err)
+	}
+	buf.StartCapturing(r, notify)
+	// The process gets its own copies of the pipes' ends
+	defer w.Close()
+	if stderr == nil {
+		stderr = w
+	}
+	var stdinW *os.File
+	if stdin != nil {
+		stdinR, pw, err := os.Pipe()
+		if err != nil {
+			return fail(err)
+		}
+		defer stdinR.Close()
+		cmd.Stdin, stdinW = stdinR, pw
 	}
 
-	cmd := exec.CommandContext(ctx, shell[0], append(shell[1:], command)...)
+	// The shell and all its children are in one process group, so that they
+	// can be killed together
+	setProcessGroup(cmd)
 	cmd.Stdout = w
-	cmd.Stderr = w
-	cmd.Stdin = stdin.NewReader(true)
-	err := cmd.Start()
+	cmd.Stderr = stderr
+	err = cmd.Start()
 	if err != nil {
-		fmt.Fprintf(w, "up: %s", err)
-		w.Close()
-		return p
+		if stdinW != nil {
+			stdinW.Close()
+		}
+		return fail(err)
 	}
 	log.Println(cmd.Path)
+	p.process = cmd.Process
+	if stdinW != nil {
+		go func() {
+			io.Copy(stdinW, stdin)
+			stdinW.Close()
+		}()
+	}
+	timedOut := make(chan struct{})
+	var timer *time.Timer
+	if maxTime > 0 {
+		timer = time.AfterFunc(maxTime, func() {
+			close(timedOut)
+			p.Kill()
+		})
+	}
 	go func() {
+		// Where possible, the process is reaped only after its group is
+		// killed, if requested, so that the group's ID can't be reused yet
+		if waitExited(p.process) {
+			select {
+			case <-p.killed:
+				// Children of the shell may outlive it, e.g. if they were
+				// started in background
+				<-p.escalated
+			default:
+				// Like after a shell exits, background jobs are left running
+			}
+			p.mu.Lock()
+			p.reaped = true
+			p.mu.Unlock()
+		}
 		err = cmd.Wait()
 		if err != nil {
-			fmt.Fprintf(w, "up: %s", err)
+			// Exit status is shown in the status bar
 			log.Printf("Wait returned error: %s", err)
 		}
-		w.Close()
+		if timer != nil && !timer.Stop() {
+			// Timer already fired, so let it finish
+			<-timedOut
+		}
+		killed := false
+		select {
+		case <-p.killed:
+			killed = true
+		default:
+		}
+		select {
+		case <-timedOut:
+			// Even if the process ignored SIGTERM, and had to be killed
+			err = fmt.Errorf("killed after exceeding --timeout (%s)", maxTime)
+		default:
+			// If killed by user, it's not because of limits
+			if limitErr := limitExceeded(cmd); limitErr != nil && !killed {
+				err = limitErr
+			}
+		}
+		if stdinW != nil {
+			// Stop feeding the process; the copying goroutine ends after
+			// failing to write more input, if any arrives
+			stdinW.Close()
+		}
+		p.err = err
+		p.ended = time.Now()
+		close(p.done)
 	}()
 	return p
 }
 
-func (s *Subprocess) Kill() {
-	if s == nil {
+// Finished reports whether the process has already ended, and if yes, with
+// what result.
+func (s *Subprocess) Finished() (bool, error) {
+	select {
+	case <-s.done:
+		return true, s.err
+	default:
+		return false, nil
+	}
+}
+
+// failed reports whether the process has finished because of an error, and
+// not just with exit status 1 (e.g. of grep finding no matches), or because
+// of Kill. See also Pipeline.Failed.
+func (s *Subprocess) failed() bool {
+	done, err := s.Finished()
+	if !done || err == nil {
+		return false
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		// Failed to start, or exceeded limits
+		return true
+	}
+	select {
+	case <-s.killed:
+		return false
+	default:
+	}
+	// Exit code is -1 if the process was killed by a signal
+	return exitErr.ExitCode() > 1 || exitErr.ExitCode() == -1
+}
+
+// Elapsed returns the wall time for which the process has been running.
+func (s *Subprocess) Elapsed() time.Duration {
+	if done, _ := s.Finished(); done {
+		return s.ended.Sub(s.started)
+	}
+	return time.Since(s.started)
+}
+
+// Kill asks the process and all its children to exit with SIGTERM, and kills
+// them with SIGKILL if they don't exit within killGrace. It doesn't wait for
+// that; see Wait.
+func (s *Subprocess) Kill() {
+	if s == nil {
+		return
+	}
+	// Output of the process is not needed anymore; if its buffer is full,
+	// capturing must stop, or else the process would never finish writing
+	s.Buf.Close()
+	if s.process == nil {
+		return
+	}
+	if done, _ := s.Finished(); done {
+		return
+	}
+	s.killOnce.Do(func() {
+		close(s.killed)
+		s.signalGroup(terminateProcessGroup)
+		go func() {
+			time.Sleep(killGrace)
+			// Kill the shell if it ignored SIGTERM, or its children if they
+			// outlived it
+			s.signalGroup(killProcessGroup)
+			close(s.escalated)
+		}()
+	})
+}
+
+// signalGroup sends a signal to the process group of s with send, unless the
+// process was already reaped.
+func (s *Subprocess) signalGroup(send func(p *os.Process) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.reaped {
+		send(s.process)
+	}
+}
+
+// Wait waits until the process finishes, and, if it was killed, until all its
+// children are killed too.
+func (s *Subprocess) Wait() {
+	if s == nil {
+		return
+	}
+	<-s.done
+}
+
+// globInputs expands glob patterns of input files, checking that the files
+// can be read. A "-" stands for standard input.
+func globInputs(patterns []string) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		if pattern == "-" {
+			paths = append(paths, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", pattern, err)
+		}
+		if len(matches) == 0 {
+			// Not a pattern; if the file doesn't exist, Stat will report it
+			matches = []string{pattern}
+		}
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() {
+				return nil, fmt.Errorf("%s: is a directory", path)
+			}
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// usesStdin returns true if the input of up is read from standard input.
+func usesStdin(files []string, command string) bool {
+	if command != "" {
+		return false
+	}
+	for _, f := range files {
+		if f == "-" {
+			return true
+		}
+	}
+	return len(files) == 0
+}
+
+// readFiles returns a reader of contents of all files one after another, like
+// cat does. A "-" stands for standard input. Errors are reported in the
+// read data, so that they can be seen by user. The reader returns EOF after
+// stop is closed.
+func readFiles(paths []string, stop <-chan struct{}) io.Reader {
+	var file io.ReadCloser
+	return funcReader(func(p []byte) (int, error) {
+		for {
+			select {
+			case <-stop:
+				if file != nil {
+					file.Close()
+				}
+				return 0, io.EOF
+			default:
+			}
+			if file == nil {
+				if len(paths) == 0 {
+					return 0, io.EOF
+				}
+				path := paths[0]
+				paths = paths[1:]
+				if path == "-" {
+					file = ioutil.NopCloser(os.Stdin)
+					continue
+				}
+				f, err := os.Open(path)
+				if err != nil {
+					return copy(p, "up: "+err.Error()+"\n"), nil
+				}
+				file = f
+			}
+			n, err := file.Read(p)
+			switch {
+			case err == io.EOF:
+				file.Close()
+				file = nil
+				if n == 0 {
+					continue
+				}
+			case err != nil:
+				file.Close()
+				file = nil
+				n += copy(p[n:], "up: "+err.Error()+"\n")
+			}
+			return n, nil
+		}
+	})
+}
+
+// confine, if not nil, modifies commands to run them in a sandbox; see
+// setupSandbox.
+var confine func(cmd *exec.Cmd)
+
+// setupSandbox returns a function modifying commands to run them with a
+// read-only view of the file system and without network access. The commands
+// are prefixed with wrapper if not empty, or else with bwrap if it's found in
+// $PATH, or else they are run in Linux namespaces. An error is returned if
+// the sandbox doesn't work.
+func setupSandbox(wrapper []string) (func(cmd *exec.Cmd), error) {
+	if len(wrapper) == 0 {
+		if _, err := exec.LookPath("bwrap"); err == nil {
+			wrapper = []string{"bwrap", "--ro-bind", "/", "/", "--dev", "/dev",
+				"--unshare-net", "--die-with-parent", "--"}
+		}
+	}
+	var confine func(cmd *exec.Cmd)
+	if len(wrapper) > 0 {
+		path, err := exec.LookPath(wrapper[0])
+		if err != nil {
+			return nil, err
+		}
+		confine = func(cmd *exec.Cmd) {
+			cmd.Args = append(append([]string{path}, wrapper[1:]...), cmd.Args...)
+			cmd.Path = path
+		}
+	} else {
+		var err error
+		confine, err = newNamespaceSandbox()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check that the sandbox works, and that it really is read-only
+	probe := exec.Command("sh", "-c", `test -w "$1" || echo read-only`, "sh", os.TempDir())
+	confine(probe)
+	output, err := probe.CombinedOutput()
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("%s %s", err, bytes.TrimSpace(output))
+	case string(output) != "read-only\n":
+		return nil, fmt.Errorf("%s is writable in the sandbox %s", os.TempDir(), bytes.TrimSpace(output))
+	}
+	return confine, nil
+}
+
+// Pipeline is a chain of Subprocesses, one per each stage of a command split
+// on top-level '|' characters. Every stage is fed with the output of the
+// previous one, so that results of any intermediate stage can be inspected.
+type Pipeline struct {
+	Stages []string
+	Input  *Buf
+	// Stderr captures error messages of all stages
+	Stderr *Buf
+	procs  []*Subprocess
+}
+
+func StartPipeline(shell []string, command string, stdin *Buf, notify func()) *Pipeline {
+	p := &Pipeline{
+		Stages: splitPipeline(command),
+		Input:  stdin,
+		Stderr: NewBuf(stdin.Limit()),
+	}
+	// Like with the output, the stages write error messages directly to a
+	// pipe, so that their end isn't delayed by copying the messages
+	var stderr io.Writer
+	r, w, err := os.Pipe()
+	if err != nil {
+		p.Stderr.StartCapturing(strings.NewReader("up: "+err.Error()+"\n"), notify)
+		stderr = ioutil.Discard
+	} else {
+		p.Stderr.StartCapturing(r, notify)
+		stderr = w
+		// The stages get their own copies of the pipe's end
+		defer w.Close()
+	}
+	for _, stage := range p.Stages {
+		s := StartSubprocess(shell, stage, stdin, stderr, notify)
+		p.procs = append(p.procs, s)
+		stdin = s.Buf
+	}
+	return p
+}
+
+// Buf returns the output of the i-th stage of the pipeline, where stages are
+// numbered from 1. Buf(0) returns the input of the whole pipeline.
+func (p *Pipeline) Buf(i int) *Buf {
+	if i == 0 {
+		return p.Input
+	}
+	return p.procs[i-1].Buf
+}
+
+// Failed reports whether the pipeline has finished because of an error, and
+// not just with a non-zero exit status like that of grep finding no matches:
+// i.e. if a stage ended with non-zero status and error messages were written,
+// or a stage failed to run, exited with status above 1, or was killed by a
+// signal not sent by Kill.
+func (p *Pipeline) Failed() bool {
+	done, err := p.Finished()
+	if !done || err == nil {
+		return false
+	}
+	if p.Stderr.Size() > 0 {
+		return true
+	}
+	for _, s := range p.procs {
+		if s.failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Procs returns the processes of the stages up to and including the i-th one.
+func (p *Pipeline) Procs(i int) []*Subprocess {
+	return p.procs[:i]
+}
+
+// Finished reports whether all stages of the pipeline have already ended, and
+// if yes, returns the error of the first failed stage, if any.
+func (p *Pipeline) Finished() (bool, error) {
+	var firstErr error
+	for _, s := range p.procs {
+		done, err := s.Finished()
+		if !done {
+			return false, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return true, firstErr
+}
+
+func (p *Pipeline) Kill() {
+	if p == nil {
 		return
 	}
-	s.cancel()
+	for _, s := range p.procs {
+		s.Kill()
+	}
+	p.Stderr.Close()
+}
+
+// Wait waits until all stages of the pipeline finish, and, if they were
+// killed, until their children are killed too.
+func (p *Pipeline) Wait() {
+	if p == nil {
+		return
+	}
+	for _, s := range p.procs {
+		s.Wait()
+	}
+}
+
+// KillAfter kills all stages of the pipeline following the i-th one.
+func (p *Pipeline) KillAfter(i int) {
+	for _, s := range p.procs[i:] {
+		s.Kill()
+	}
+}
+
+// fork is a saved state from before the output of a command was made the new
+// input of the pipeline.
+type fork struct {
+	input    *Buf
+	command  string
+	pipeline *Pipeline // producing the forked output; nil if it was a snapshot
+}
+
+// forkStack keeps the states from before each fork of the pipeline, the most
+// recent one last.
+type forkStack []fork
+
+func (s *forkStack) push(f fork) {
+	*s = append(*s, f)
+}
+
+// pop removes the most recent fork, and returns it together with the edited
+// command prefixed with the forked command.
+func (s *forkStack) pop(edited string) (fork, string) {
+	f := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	switch {
+	case f.command != "" && edited != "":
+		edited = f.command + " | " + edited
+	case f.command != "":
+		edited = f.command
+	}
+	return f, edited
+}
+
+// command returns the edited command, prefixed with all forked commands.
+func (s forkStack) command(edited string) string {
+	var cmds []string
+	for _, f := range s {
+		if f.command != "" {
+			cmds = append(cmds, f.command)
+		}
+	}
+	if edited != "" || len(cmds) == 0 {
+		cmds = append(cmds, edited)
+	}
+	return strings.Join(cmds, " | ")
+}
+
+// prompt returns the prompt of the command editor, showing the number of
+// forks if there are any.
+func (s forkStack) prompt() string {
+	if len(s) == 0 {
+		return "| "
+	}
+	return fmt.Sprintf("[%d]| ", len(s))
+}
+
+// kill kills the commands producing the forked outputs.
+func (s forkStack) kill() {
+	for _, f := range s {
+		f.pipeline.Kill()
+	}
+}
+
+// base returns the input of up from before the first fork, or current if the
+// pipeline was not forked.
+func (s forkStack) base(current *Buf) *Buf {
+	if len(s) == 0 {
+		return current
+	}
+	return s[0].input
+}
+
+// defaultSafeCommands are commands which only write to standard output, at
+// least when used without the options and scripts checked in sideEffectArgs.
+var defaultSafeCommands = []string{
+	"awk", "base64", "cat", "column", "cut", "echo", "egrep", "expand",
+	"fgrep", "fmt", "fold", "gawk", "grep", "head", "jq", "mawk", "nl", "od",
+	"paste", "printf", "rev", "sed", "seq", "sort", "tac", "tail", "tr",
+	"uniq", "wc",
+}
+
+// sideEffectArgs lists checks of arguments of some commands, which can write
+// to files when given certain options. A check returns the first argument
+// with side effects, or "" if there's none.
+var sideEffectArgs = map[string]func(args []string) string{
+	"sed":  sedOptions.check,
+	"sort": sortOptions.check,
+	"uniq": func(args []string) string {
+		// Second operand is the output file
+		var operands []string
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "-") || arg == "-" {
+				operands = append(operands, arg)
+			}
+		}
+		if len(operands) > 1 {
+			return operands[1]
+		}
+		return ""
+	},
+	"awk":  awkOptions.check,
+	"gawk": awkOptions.check,
+	"mawk": awkOptions.check,
+}
+
+// optionKind tells how an option of a command is checked for side effects.
+type optionKind int
+
+const (
+	optUnsafe optionKind = iota // may have side effects, or can't be checked
+	optFlag                     // takes no value
+	optValue                    // takes a value, which is safe
+	optScript                   // takes a value, which is a script to check
+)
+
+// commandOptions describes options of a command, parsed like by getopt_long,
+// for finding the ones which may have side effects.
+type commandOptions struct {
+	short map[rune]optionKind
+	// long options may be abbreviated, as long as they're unambiguous
+	long map[string]optionKind
+	// unknown is the kind of options not listed above
+	unknown optionKind
+	// unsafeScript, if not nil, reports whether a script given in an option,
+	// or else as the first operand, may have side effects
+	unsafeScript func(script string) bool
+}
+
+var sedOptions = commandOptions{
+	// Option -l takes a value in GNU sed, but not in BSD sed, so it's hard to
+	// say what the following argument is
+	short: map[rune]optionKind{
+		'n': optFlag, 'E': optFlag, 'r': optFlag, 's': optFlag, 'u': optFlag,
+		'z': optFlag, 'e': optScript, 'f': optUnsafe, 'i': optUnsafe, 'l': optUnsafe,
+	},
+	long: map[string]optionKind{
+		"quiet": optFlag, "silent": optFlag, "regexp-extended": optFlag,
+		"separate": optFlag, "unbuffered": optFlag, "null-data": optFlag,
+		"zero-terminated": optFlag, "posix": optFlag, "debug": optFlag,
+		"sandbox": optFlag, "line-length": optValue, "expression": optScript,
+		"file": optUnsafe, "in-place": optUnsafe,
+	},
+	unknown:      optUnsafe,
+	unsafeScript: sedUnsafe,
+}
+
+var sortOptions = commandOptions{
+	short: map[rune]optionKind{
+		'k': optValue, 't': optValue, 'S': optValue, 'T': optValue, 'o': optUnsafe,
+	},
+	long: map[string]optionKind{
+		"key": optValue, "field-separator": optValue, "buffer-size": optValue,
+		"temporary-directory": optValue, "batch-size": optValue,
+		"files0-from": optValue, "random-source": optValue, "parallel": optValue,
+		"sort": optValue, "output": optUnsafe, "compress-program": optUnsafe,
+	},
+	unknown: optFlag,
+}
+
+var awkOptions = commandOptions{
+	short: map[rune]optionKind{
+		'F': optValue, 'v': optValue, 'e': optScript, 'b': optFlag, 'c': optFlag,
+		'n': optFlag, 'N': optFlag, 'P': optFlag, 'r': optFlag, 'S': optFlag,
+	},
+	long: map[string]optionKind{
+		"field-separator": optValue, "assign": optValue, "source": optScript,
+		"characters-as-bytes": optFlag, "traditional": optFlag,
+		"non-decimal-data": optFlag, "use-lc-numeric": optFlag, "posix": optFlag,
+		"re-interval": optFlag, "sandbox": optFlag,
+	},
+	unknown: optUnsafe,
+	// Redirected output, pipes, system(), and gawk directives which may load
+	// extensions like "inplace"
+	unsafeScript: regexp.MustCompile(`\bprintf?\b[^;}]*[>|]|[^|]\|[^|]|\bsystem\s*\(|@\s*(include|load|namespace)\b`).MatchString,
+}
+
+// check returns the first of args which is an option with side effects, or a
+// script which may have side effects, or "" if there's none.
+func (c commandOptions) check(args []string) string {
+	var operands []string
+	scripts := 0
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			operands = append(operands, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "--"):
+			name, value := arg[2:], ""
+			hasValue := strings.Contains(name, "=")
+			if hasValue {
+				kv := strings.SplitN(name, "=", 2)
+				name, value = kv[0], kv[1]
+			}
+			kind := c.longKind(name)
+			if kind == optUnsafe {
+				return arg
+			}
+			if kind == optFlag {
+				continue
+			}
+			if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if kind == optScript {
+				scripts++
+				if c.unsafeScript(value) {
+					return value
+				}
+			}
+		case len(arg) > 1 && arg[0] == '-':
+			for j, opt := range arg[1:] {
+				kind, ok := c.short[opt]
+				if !ok {
+					kind = c.unknown
+				}
+				if kind == optUnsafe {
+					return arg
+				}
+				if kind == optFlag {
+					continue
+				}
+				// The value follows in the same or the next argument
+				value := arg[1+j+utf8.RuneLen(opt):]
+				if value == "" && i+1 < len(args) {
+					i++
+					value = args[i]
+				}
+				if kind == optScript {
+					scripts++
+					if c.unsafeScript(value) {
+						return value
+					}
+				}
+				break
+			}
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	if c.unsafeScript != nil && scripts == 0 && len(operands) > 0 && c.unsafeScript(operands[0]) {
+		return operands[0]
+	}
+	return ""
+}
+
+// longKind returns the kind of the long option name, which may be
+// abbreviated. Ambiguous abbreviations are reported as unsafe.
+func (c commandOptions) longKind(name string) optionKind {
+	if kind, ok := c.long[name]; ok {
+		return kind
+	}
+	kind, matches := c.unknown, 0
+	for long, k := range c.long {
+		if strings.HasPrefix(long, name) {
+			kind, matches = k, matches+1
+		}
+	}
+	if matches > 1 {
+		return optUnsafe
+	}
+	return kind
+}
+
+// sedUnsafe reports whether a sed script may write to files or run commands,
+// with commands 'w', 'W' or 'e', or flags 'w' or 'e' of command 's'. Scripts
+// which can't be parsed are reported too, erring on the side of caution.
+func sedUnsafe(script string) bool {
+	i := 0
+	skipSpace := func() {
+		for i < len(script) && (script[i] == ' ' || script[i] == '\t') {
+			i++
+		}
+	}
+	// skipUntil skips text up to and including an unescaped delim
+	skipUntil := func(delim byte) bool {
+		for ; i < len(script); i++ {
+			switch script[i] {
+			case '\\':
+				i++
+			case delim:
+				i++
+				return true
+			}
+		}
+		return false
+	}
+	skipAddress := func() bool {
+		switch {
+		case i < len(script) && script[i] == '/':
+			i++
+		case i+1 < len(script) && script[i] == '\\':
+			i += 2
+		default:
+			for i < len(script) && strings.IndexByte("0123456789$~+", script[i]) != -1 {
+				i++
+			}
+			return true
+		}
+		if !skipUntil(script[i-1]) {
+			return false
+		}
+		// Flags of the regular expression
+		for i < len(script) && (script[i] == 'I' || script[i] == 'M') {
+			i++
+		}
+		return true
+	}
+	for i < len(script) {
+		skipSpace()
+		if !skipAddress() {
+			return true
+		}
+		skipSpace()
+		if i < len(script) && script[i] == ',' {
+			i++
+			skipSpace()
+			if !skipAddress() {
+				return true
+			}
+		}
+		for skipSpace(); i < len(script) && script[i] == '!'; skipSpace() {
+			i++
+		}
+		if i == len(script) {
+			break
+		}
+		cmd := script[i]
+		i++
+		switch cmd {
+		case ';', '\n', '{', '}', '=', 'd', 'D', 'g', 'G', 'h', 'H', 'n', 'N',
+			'p', 'P', 'x', 'z', 'F', 'l', 'L', 'q', 'Q':
+			// Commands without arguments, or with a numeric one, which is
+			// skipped like an address
+		case 'a', 'i', 'c', 'r', 'R', '#':
+			// Text or file name to read, up to the end of line
+			for i < len(script) && script[i] != '\n' {
+				if script[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case ':', 'b', 't', 'T', 'v':
+			// Label, up to the end of line or a semicolon
+			for i < len(script) && script[i] != '\n' && script[i] != ';' {
+				i++
+			}
+		case 's', 'y':
+			if i == len(script) {
+				return true
+			}
+			delim := script[i]
+			i++
+			if !skipUntil(delim) || !skipUntil(delim) {
+				return true
+			}
+			for cmd == 's' && i < len(script) && strings.IndexByte("0123456789gpiImMwe", script[i]) != -1 {
+				if script[i] == 'w' || script[i] == 'e' {
+					return true
+				}
+				i++
+			}
+		default:
+			// Including 'w', 'W' and 'e'
+			return true
+		}
+	}
+	return false
+}
+
+// checkSideEffects returns an error if command may have side effects, i.e. if
+// any of its simple commands is not one of safe commands, or is used with
+// arguments listed in sideEffectArgs, or if the command redirects output to a
+// file (other than /dev/null), or contains command substitution or subshells.
+// The command is parsed in a simplified way, which errs on the side of caution.
+func checkSideEffects(command string, safe []string) error {
+	var (
+		words []string // words of the current simple command
+		word  []rune
+		// whether word was started (it may be an empty quoted string)
+		inWord bool
+		// whether the current word is a target of an input redirection
+		redirected bool
+	)
+	endWord := func() {
+		if inWord && !redirected {
+			words = append(words, string(word))
+		}
+		word, inWord, redirected = word[:0], false, redirected && !inWord
+	}
+	endCommand := func() error {
+		endWord()
+		err := checkSimpleCommand(words, safe)
+		words = nil
+		return err
+	}
+	rs := []rune(command)
+	next := func(i int) rune {
+		if i+1 < len(rs) {
+			return rs[i+1]
+		}
+		return 0
+	}
+	for i := 0; i < len(rs); i++ {
+		ch := rs[i]
+		switch {
+		case ch == '\\':
+			if i+1 < len(rs) {
+				i++
+				word = append(word, rs[i])
+			}
+			inWord = true
+		case ch == '\'':
+			j := i + 1
+			for j < len(rs) && rs[j] != '\'' {
+				j++
+			}
+			word = append(word, rs[i+1:j]...)
+			i, inWord = j, true
+		case ch == '"':
+			for i++; i < len(rs) && rs[i] != '"'; i++ {
+				switch {
+				case rs[i] == '`' || rs[i] == '$' && next(i) == '(':
+					return errors.New("command substitution")
+				case rs[i] == '\\' && i+1 < len(rs):
+					i++
+				}
+				word = append(word, rs[i])
+			}
+			inWord = true
+		case ch == '`' || ch == '$' && next(i) == '(':
+			return errors.New("command substitution")
+		case ch == '(' || ch == ')':
+			return errors.New("subshell")
+		case ch == '#' && !inWord:
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+			i--
+		case ch == '&' && next(i) == '>':
+			return errors.New("output redirection")
+		case ch == '|' || ch == ';' || ch == '&' || ch == '\n':
+			if err := endCommand(); err != nil {
+				return err
+			}
+			if n := next(i); n == ch || ch == '|' && n == '&' || ch == ';' && n == ';' {
+				i++
+			}
+		case ch == '>':
+			if inWord && strings.Trim(string(word), "0123456789") == "" {
+				// File descriptor number
+				word, inWord = word[:0], false
+			}
+			endWord()
+			i++
+			if i < len(rs) && rs[i] == '&' {
+				// Duplicating a file descriptor, like in 2>&1, is safe; but
+				// '>&word' redirects both outputs to the file
+				j := i + 1
+				for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '-') {
+					j++
+				}
+				if j > i+1 && (j == len(rs) || strings.ContainsRune(" \t\n|&;<>()", rs[j])) {
+					i = j - 1
+					continue
+				}
+			}
+			if i < len(rs) && (rs[i] == '>' || rs[i] == '|' || rs[i] == '&') {
+				i++
+			}
+			for i < len(rs) && (rs[i] == ' ' || rs[i] == '\t') {
+				i++
+			}
+			j := i
+			for j < len(rs) && !strings.ContainsRune(" \t\n|&;<>()", rs[j]) {
+				j++
+			}
+			if string(rs[i:j]) != "/dev/null" {
+				return errors.New("output redirection")
+			}
+			i = j - 1
+		case ch == '<':
+			switch next(i) {
+			case '(':
+				return errors.New("process substitution")
+			case '>':
+				return errors.New("output redirection")
+			}
+			if inWord && strings.Trim(string(word), "0123456789") == "" {
+				word, inWord = word[:0], false
+			}
+			endWord()
+			for next(i) == '<' {
+				i++
+			}
+			redirected = true
+		case unicode.IsSpace(ch):
+			endWord()
+		default:
+			word = append(word, ch)
+			inWord = true
+		}
+	}
+	return endCommand()
+}
+
+var assignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// checkSimpleCommand returns an error if the command consisting of words may
+// have side effects.
+func checkSimpleCommand(words []string, safe []string) error {
+	// Skip variable assignments preceding the command
+	for len(words) > 0 && assignment.MatchString(words[0]) {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		// Nothing to run, e.g. an empty stage of a pipeline being typed
+		return nil
+	}
+	name := words[0]
+	for _, s := range safe {
+		if s == name {
+			if check := sideEffectArgs[name]; check != nil {
+				if arg := check(words[1:]); arg != "" {
+					return fmt.Errorf("%s %s may have side effects", name, arg)
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a --safe-commands command", name)
+}
+
+// splitPipeline splits command into stages on '|' characters, ignoring ones
+// that are quoted, escaped, or nested inside (), {}, $(), backticks, comments,
+// case...esac or other compound commands. A '|&' separator is translated to
+// '2>&1' appended to the preceding stage, as the stages are run separately. An
+// empty last stage (like when user is still typing "foo |") is dropped. If
+// command is a list of pipelines, joined with ';', '&&', '||', '&' or newlines,
+// it's not split, as its stages couldn't be run separately.
+func splitPipeline(command string) []string {
+	var (
+		stages []string
+		stage  []rune
+		nest   []rune // stack of open quotes & brackets
+		word   []rune // current top-level word, for detecting keywords
+		cases  int    // depth of case...esac blocks
+		blocks int    // depth of other compound commands, like if...fi
+		// whether word is in the position of a command name, where it may be
+		// a keyword
+		cmdPos = true
+		// whether command is a list of pipelines
+		list bool
+	)
+	top := func() rune {
+		if len(nest) == 0 {
+			return 0
+		}
+		return nest[len(nest)-1]
+	}
+	endWord := func() {
+		if len(word) == 0 {
+			return
+		}
+		switch string(word) {
+		case "case":
+			cases++
+		case "esac":
+			if cases > 0 {
+				cases--
+			}
+		}
+		if cmdPos {
+			switch string(word) {
+			case "if", "while", "until", "for", "select":
+				blocks++
+			case "fi", "done":
+				if blocks > 0 {
+					blocks--
+				}
+			}
+		}
+		switch string(word) {
+		case "if", "while", "until", "then", "do", "else", "elif", "!", "time":
+			// Followed by a command
+		default:
+			cmdPos = false
+		}
+		word = word[:0]
+	}
+	cmd := []rune(command)
+	for i := 0; i < len(cmd); i++ {
+		ch := cmd[i]
+		switch {
+		case top() == '\'':
+			if ch == '\'' {
+				nest = nest[:len(nest)-1]
+			}
+		case ch == '\\':
+			if i+1 < len(cmd) {
+				stage = append(stage, ch)
+				i++
+				ch = cmd[i]
+			}
+		case top() == '"':
+			switch ch {
+			case '"':
+				nest = nest[:len(nest)-1]
+			case '`':
+				nest = append(nest, ch)
+			case '(':
+				if i > 0 && cmd[i-1] == '$' {
+					nest = append(nest, ch)
+				}
+			}
+		case ch == '\'' || ch == '"':
+			nest = append(nest, ch)
+		case ch == '`':
+			if top() == '`' {
+				nest = nest[:len(nest)-1]
+			} else {
+				nest = append(nest, ch)
+			}
+		case ch == '(' || ch == '{':
+			nest = append(nest, ch)
+		case ch == ')' && top() == '(',
+			ch == '}' && top() == '{':
+			nest = nest[:len(nest)-1]
+		case ch == '#' && len(nest) == 0 && len(word) == 0 &&
+			(i == 0 || unicode.IsSpace(cmd[i-1]) || strings.ContainsRune(";&|", cmd[i-1])):
+			// Comment till the end of line - just copy it verbatim
+			stage = append(stage, cmd[i:]...)
+			i = len(cmd)
+			continue
+		case len(nest) > 0:
+			// nothing to do
+		case unicode.IsSpace(ch) || strings.ContainsRune(";&<>", ch):
+			endWord()
+			rest := strings.TrimSpace(string(cmd[i+1:]))
+			switch {
+			case ch == '&' && (i > 0 && strings.ContainsRune("<>", cmd[i-1]) || i+1 < len(cmd) && cmd[i+1] == '>'):
+				// Redirection, like '2>&1' or '&>'
+			case ch == '&' || (ch == ';' || ch == '\n') && rest != "":
+				// Trailing ';' or newline don't make a list
+				if cases == 0 && blocks == 0 && strings.TrimSpace(string(stage)) != "" {
+					list = true
+				}
+				cmdPos = true
+			}
+		case ch == '|':
+			endWord()
+			cmdPos = true
+			if cases > 0 {
+				break
+			}
+			if i+1 < len(cmd) && cmd[i+1] == '|' {
+				// Logical OR operator: '||'
+				if blocks == 0 {
+					list = true
+				}
+				stage = append(stage, ch, ch)
+				i++
+				continue
+			}
+			s := strings.TrimSpace(string(stage))
+			if i+1 < len(cmd) && cmd[i+1] == '&' {
+				s += " 2>&1"
+				i++
+			}
+			stages = append(stages, s)
+			stage = stage[:0]
+			continue
+		default:
+			word = append(word, ch)
+		}
+		stage = append(stage, ch)
+	}
+	if list {
+		return []string{strings.TrimSpace(command)}
+	}
+	s := strings.TrimSpace(string(stage))
+	if s != "" || len(stages) == 0 {
+		stages = append(stages, s)
+	}
+	return stages
+}
+
+// Snapshot is a saved pair of a command and its output.
+type Snapshot struct {
+	Command string
+	Buf     *Buf
+}
+
+// Restore puts the command of the snapshot in editor, and its output in view,
+// without rerunning the command.
+func (s Snapshot) Restore(editor *Editor, view *BufView) {
+	editor.edit(editOther, func() { editor.set(s.Command) })
+	view.Buf = s.Buf
+	view.normalizeY()
+}
+
+// NewSnapshotMenu returns a Menu for picking one of snapshots, with the most
+// recent one selected.
+func NewSnapshotMenu(snapshots []Snapshot) *Menu {
+	m := &Menu{Selected: len(snapshots) - 1}
+	for i, snap := range snapshots {
+		m.Items = append(m.Items, fmt.Sprintf("%3d | %s", i+1, snap.Command))
+	}
+	return m
+}
+
+// Menu is a list of items, of which user can select one.
+type Menu struct {
+	Items    []string
+	Selected int
+}
+
+func (m *Menu) DrawTo(region Region) {
+	top := 0
+	if m.Selected >= region.H {
+		top = m.Selected - region.H + 1
+	}
+	for y := 0; y < region.H; y++ {
+		i := top + y
+		style, text := tcell.StyleDefault, ""
+		if i < len(m.Items) {
+			text = m.Items[i]
+		}
+		if i == m.Selected {
+			style = whiteOnBlue
+		}
+		row := Region{
+			W: region.W, H: 1,
+			SetCell: func(x, _ int, style tcell.Style, ch ...rune) { region.SetCell(x, y, style, ch...) },
+		}
+		for x := drawRunes(row, 0, style, []rune(text)); x < region.W; x++ {
+			region.SetCell(x, y, style, ' ')
+		}
+	}
+}
+
+func (m *Menu) HandleKey(ev *tcell.EventKey, scrollY int) bool {
+	switch getKey(ev) {
+	case key(tcell.KeyUp):
+		m.Selected--
+	case key(tcell.KeyDown):
+		m.Selected++
+	case key(tcell.KeyPgUp):
+		m.Selected -= scrollY
+	case key(tcell.KeyPgDn):
+		m.Selected += scrollY
+	case key(tcell.KeyHome):
+		m.Selected = 0
+	case key(tcell.KeyEnd):
+		m.Selected = len(m.Items) - 1
+	default:
+		// Unknown key/combination, not handled
+		return false
+	}
+	if m.Selected >= len(m.Items) {
+		m.Selected = len(m.Items) - 1
+	}
+	if m.Selected < 0 {
+		m.Selected = 0
+	}
+	return true
 }
 
 type key int32
 
-func getKey(ev *tcell.EventKey) key { return key(ev.Modifiers())<<16 + key(ev.Key()) }
-func altKey(base tcell.Key) key     { return key(tcell.ModAlt)<<16 + key(base) }
-func ctrlKey(base tcell.Key) key    { return key(tcell.ModCtrl)<<16 + key(base) }
+// runeFlag marks keys representing characters, which are encoded together
+// with modifiers as: runeFlag + modifiers<<21 + rune
+const runeFlag key = 1 << 30
+
+func getKey(ev *tcell.EventKey) key {
+	if ev.Key() == tcell.KeyRune {
+		return runeFlag + key(ev.Modifiers())<<21 + key(ev.Rune())
+	}
+	return key(ev.Modifiers())<<16 + key(ev.Key())
+}
+func altKey(base tcell.Key) key  { return key(tcell.ModAlt)<<16 + key(base) }
+func ctrlKey(base tcell.Key) key { return key(tcell.ModCtrl)<<16 + key(base) }
+func altRune(ch rune) key        { return runeFlag + key(tcell.ModAlt)<<21 + key(ch) }
 
-func writeScript(shell []string, command string, tui tcell.Screen) {
+func writeScript(script *Script, tui tcell.Screen) {
 	os.Stderr.WriteString("up: Ultimate Plumber v" + version + " https://github.com/akavel/up\n")
+	ext, mode := ".sh", os.FileMode(0755)
+	switch *outputFormat {
+	case "function":
+		mode = 0644
+	case "make":
+		ext, mode = ".mk", 0644
+	}
 	var f *os.File
 	var err error
 	if *outputScript != "" {
 		os.Stderr.WriteString("up: writing " + *outputScript)
-		f, err = os.OpenFile(*outputScript, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		f, err = os.OpenFile(*outputScript, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 		if err != nil {
 			goto fallback_tmp
 		}
@@ -806,7 +3780,7 @@ func writeScript(shell []string, command string, tui tcell.Screen) {
 
 	os.Stderr.WriteString("up: writing: .")
 	for i := 1; i < 1000; i++ {
-		f, err = os.OpenFile(fmt.Sprintf("up%d.sh", i), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+		f, err = os.OpenFile(fmt.Sprintf("up%d%s", i, ext), os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
 		switch {
 		case os.IsExist(err):
 			continue
@@ -817,12 +3791,11 @@ func writeScript(shell []string, command string, tui tcell.Screen) {
 			goto try_file
 		}
 	}
-	os.Stderr.WriteString(" - error: up1.sh-up999.sh already exist\n")
+	os.Stderr.WriteString(" - error: up1" + ext + "-up999" + ext + " already exist\n")
 	goto fallback_tmp
 
 try_file:
-	// NOTE: currently not supporting multi-word shell in upNNN.sh unfortunately :(
-	_, err = fmt.Fprintf(f, "#!%s\n%s\n", shell[0], command)
+	_, err = f.WriteString(script.Format(*outputFormat, scriptName(f.Name())))
 	if err != nil {
 		goto fallback_tmp
 	}
@@ -836,11 +3809,11 @@ try_file:
 fallback_tmp:
 	// TODO: test if the fallbacks etc. protections actually work
 	os.Stderr.WriteString(" - error: " + err.Error() + "\n")
-	f, err = ioutil.TempFile("", "up-*.sh")
+	f, err = ioutil.TempFile("", "up-*"+ext)
 	if err != nil {
 		goto fallback_print
 	}
-	_, err = fmt.Fprintf(f, "#!%s\n%s\n", shell, command)
+	_, err = f.WriteString(script.Format(*outputFormat, scriptName(f.Name())))
 	if err != nil {
 		goto fallback_print
 	}
@@ -849,7 +3822,7 @@ fallback_tmp:
 		goto fallback_print
 	}
 	os.Stderr.WriteString("up: writing: " + f.Name() + " - OK\n")
-	os.Chmod(f.Name(), 0755)
+	os.Chmod(f.Name(), mode)
 	return
 
 fallback_print:
@@ -858,23 +3831,372 @@ fallback_print:
 		fname = f.Name()
 	}
 	os.Stderr.WriteString("up: writing: " + fname + " - error: " + err.Error() + "\n")
-	os.Stderr.WriteString("up: | " + command + "\n")
+	os.Stderr.WriteString("up: | " + script.Command + "\n")
+}
+
+// Script is a pipeline saved to a file with Ctrl-X.
+type Script struct {
+	// Shell runs the pipeline, like the --exec option
+	Shell   []string
+	Command string
+	// Input is a command which produced the input of the pipeline, if known
+	Input string
+	// Interpreter is the '#!' line of the script read with ReadScript; if
+	// empty, it is built from Shell
+	Interpreter string
+}
+
+// inputComment prefixes a comment with Script.Input
+const inputComment = "# input: "
+
+// ReadScript parses a script saved in "script" format. The shell of the script
+// is derived from its interpreter line.
+func ReadScript(path string) (*Script, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	if !strings.HasPrefix(lines[0], "#!") {
+		return nil, fmt.Errorf("%s: not a script, expected a '#!' line", path)
+	}
+	script := &Script{Interpreter: strings.TrimSpace(lines[0][2:])}
+	script.Shell = scriptShell(script.Interpreter)
+	for _, line := range lines[1:] {
+		switch {
+		case strings.HasPrefix(line, inputComment):
+			script.Input = strings.TrimPrefix(line, inputComment)
+		case strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#"):
+			continue
+		case script.Command != "":
+			return nil, fmt.Errorf("%s: more than one line of commands, up can only edit a single-line pipeline", path)
+		default:
+			script.Command = line
+		}
+	}
+	return script, nil
+}
+
+// Format renders the script as a file in the specified format: "script",
+// "function" or "make". The name is used for a shell function or a make target.
+func (s *Script) Format(format, name string) string {
+	buf := &strings.Builder{}
+	interpreter, direct := s.Interpreter, true
+	if interpreter == "" {
+		interpreter, direct = scriptInterpreter(s.Shell)
+	}
+	// If the shell can't run a script from a file, a wrapper is needed
+	wrapper := make([]string, 0, len(s.Shell)+1)
+	for _, word := range s.Shell {
+		wrapper = append(wrapper, shellQuote(word))
+	}
+	wrapped := strings.Join(append(wrapper, shellQuote(s.Command)), " ")
+
+	switch format {
+	case "function":
+		if s.Input != "" {
+			fmt.Fprintf(buf, "%s%s\n", inputComment, s.Input)
+		}
+		body := s.Command
+		if !posixShell(s.Shell) {
+			body = wrapped
+		}
+		fmt.Fprintf(buf, "%s() {\n\t%s\n}\n", name, body)
+	case "make":
+		if s.Input != "" {
+			fmt.Fprintf(buf, "%s%s\n", inputComment, s.Input)
+		}
+		fmt.Fprintf(buf, ".PHONY: %s\n%s:\n\t%s\n", name, name, strings.Replace(wrapped, "$", "$$", -1))
+	default:
+		if !direct {
+			interpreter = "/bin/sh"
+		}
+		fmt.Fprintf(buf, "#!%s\n", interpreter)
+		if s.Input != "" {
+			fmt.Fprintf(buf, "%s%s\n", inputComment, s.Input)
+		}
+		if direct {
+			fmt.Fprintf(buf, "%s\n", s.Command)
+		} else {
+			fmt.Fprintf(buf, "exec %s\n", wrapped)
+		}
+	}
+	return buf.String()
+}
+
+// scriptShell returns the command which runs a pipeline the same way as
+// a script with the specified interpreter line would run it.
+func scriptShell(interpreter string) []string {
+	shell := strings.Fields(interpreter)
+	if len(shell) > 1 && filepath.Base(shell[0]) == "env" {
+		// Programs run by env are found in $PATH, as they would be by us
+		switch {
+		case shell[1] == "-S":
+			shell = splitWords(strings.SplitN(interpreter, "-S", 2)[1])
+		case !strings.HasPrefix(shell[1], "-") && !assignment.MatchString(shell[1]):
+			shell = shell[1:]
+		}
+	}
+	if len(shell) == 0 || shell[len(shell)-1] != "-c" {
+		shell = append(shell, "-c")
+	}
+	return shell
+}
+
+// scriptInterpreter returns the '#!' line (without "#!") of a script which
+// runs a pipeline the same way as shell. It returns false if shell doesn't
+// end with '-c', so that it can't be expected to run a script from a file.
+func scriptInterpreter(shell []string) (string, bool) {
+	if len(shell) < 2 || shell[len(shell)-1] != "-c" {
+		return "", false
+	}
+	words := shell[:len(shell)-1]
+	switch {
+	case len(words) == 1 && filepath.IsAbs(words[0]):
+		return words[0], true
+	case len(words) == 1:
+		return "/usr/bin/env " + words[0], true
+	}
+	// Linux passes everything after the interpreter as a single argument, so
+	// env is used to split it into words
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = shellQuote(word)
+	}
+	return "/usr/bin/env -S " + strings.Join(quoted, " "), true
+}
+
+// posixShell returns true if shell runs commands in the same way as a shell
+// function would.
+func posixShell(shell []string) bool {
+	if len(shell) != 2 || shell[1] != "-c" {
+		return false
+	}
+	switch filepath.Base(shell[0]) {
+	case "sh", "bash", "dash", "ksh", "mksh", "zsh", "ash":
+		return true
+	}
+	return false
+}
+
+var nonName = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// scriptName returns a name of a shell function or make target based on the
+// path of the file it's saved in.
+func scriptName(path string) string {
+	name := filepath.Base(path)
+	name = nonName.ReplaceAllString(strings.TrimSuffix(name, filepath.Ext(name)), "_")
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "up" + name
+	}
+	return name
+}
+
+// splitWords splits s into words on spaces, removing quotes and backslashes
+// like a shell does (but without expanding variables or anything else).
+func splitWords(s string) []string {
+	var (
+		words  []string
+		word   []rune
+		inWord bool
+	)
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		switch ch := rs[i]; {
+		case ch == '\\' && i+1 < len(rs):
+			i++
+			word, inWord = append(word, rs[i]), true
+		case ch == '\'':
+			for i++; i < len(rs) && rs[i] != '\''; i++ {
+				word = append(word, rs[i])
+			}
+			inWord = true
+		case ch == '"':
+			for i++; i < len(rs) && rs[i] != '"'; i++ {
+				if rs[i] == '\\' && i+1 < len(rs) {
+					i++
+				}
+				word = append(word, rs[i])
+			}
+			inWord = true
+		case unicode.IsSpace(ch):
+			if inWord {
+				words = append(words, string(word))
+			}
+			word, inWord = word[:0], false
+		default:
+			word, inWord = append(word, ch), true
+		}
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// Modes of showing error messages of a pipeline
+const (
+	errorsPane   = iota // in a pane below the output, if there are any
+	errorsOnly          // instead of the output
+	errorsHidden        // not at all
+	errorsModes         // number of modes
+)
+
+// restyledRegion returns a Region drawing to region, with the style of every
+// cell modified by restyle.
+func restyledRegion(region Region, restyle func(tcell.Style) tcell.Style) Region {
+	return Region{
+		W: region.W, H: region.H,
+		SetCell: func(x, y int, style tcell.Style, ch ...rune) {
+			region.SetCell(x, y, restyle(style), ch...)
+		},
+	}
+}
+
+// errorsRegion returns a Region drawing to region, in which text is red unless
+// colored otherwise.
+func errorsRegion(region Region) Region {
+	return restyledRegion(region, func(style tcell.Style) tcell.Style {
+		if fg, _, _ := style.Decompose(); fg == tcell.ColorDefault {
+			style = style.Foreground(tcell.ColorRed)
+		}
+		return style
+	})
+}
+
+// drawLastGood shows in region the dimmed output of the last successful
+// command, below a banner explaining what it is. The output is shown with
+// view, and its position should be drawn in the line below the banner.
+func drawLastGood(region Region, view *BufView, command string) {
+	banner := Region{W: region.W, H: 1, SetCell: region.SetCell}
+	drawText(banner, whiteOnRed, strings.Repeat(" ", region.W))
+	drawText(banner, whiteOnRed, "command failed; showing output of last successful command: | "+command)
+	view.DrawTo(dimmedRegion(Region{
+		W: region.W, H: region.H - 1,
+		SetCell: func(x, y int, style tcell.Style, ch ...rune) {
+			region.SetCell(x, y+1, style, ch...)
+		},
+	}))
+}
+
+// dimmedRegion returns a Region drawing to region, in which text is dimmed.
+func dimmedRegion(region Region) Region {
+	return restyledRegion(region, func(style tcell.Style) tcell.Style {
+		return style.Dim(true)
+	})
+}
+
+// StatusBar shows how much data was captured in a Buf, and the state of the
+// processes producing it.
+type StatusBar struct {
+	// Info is shown at the start of the bar
+	Info string
+	Buf  *Buf
+	// Procs are all processes which contributed to the data in Buf, i.e.
+	// the stages of a pipeline up to the displayed one; none if the Buf
+	// contains the input or a snapshot
+	Procs []*Subprocess
+	// Mode is shown at the end of the bar, in ModeStyle
+	Mode      string
+	ModeStyle tcell.Style
+}
+
+// Running reports whether the process producing the Buf is still running.
+func (s StatusBar) Running() bool {
+	if len(s.Procs) == 0 {
+		return false
+	}
+	done, _ := s.Procs[len(s.Procs)-1].Finished()
+	return !done
+}
+
+func (s StatusBar) DrawTo(region Region) {
+	lines := fmt.Sprintf("%d lines", s.Buf.textLines())
+	if lines == "1 lines" {
+		lines = "1 line"
+	}
+	text := fmt.Sprintf("%s  %s  %s ", lines, formatSize(s.Buf.Size()), s.Buf.State())
+	if s.Info != "" {
+		text = s.Info + "  " + text
+	}
+	x := drawRunes(region, 0, whiteOnBlue, []rune(text))
+
+	// Show failures of any stage, as they may explain wrong results in the
+	// following stages
+	if len(s.Procs) > 0 {
+		style := whiteOnBlue
+		last := s.Procs[len(s.Procs)-1]
+		text = fmt.Sprintf(" exit status 0 in %s ", formatDuration(last.Elapsed()))
+		if s.Running() {
+			style = blackOnYellow
+			text = fmt.Sprintf(" running for %s ", formatDuration(last.Elapsed()))
+		}
+		for i, p := range s.Procs {
+			if done, err := p.Finished(); done && err != nil {
+				style = whiteOnRed
+				text = fmt.Sprintf(" %s in %s ", err, formatDuration(p.Elapsed()))
+				if len(s.Procs) > 1 {
+					text = fmt.Sprintf(" stage %d:%s", i+1, text)
+				}
+				break
+			}
+		}
+		x = drawRunes(region, x, style, []rune(text))
+	}
+	if err := s.Buf.Err(); err != nil {
+		x = drawRunes(region, x, whiteOnRed, []rune(" "+err.Error()+" "))
+	}
+	for ; x < region.W; x++ {
+		region.SetCell(x, 0, whiteOnBlue, ' ')
+	}
+	if s.Mode != "" {
+		mode := []rune(" " + s.Mode + " ")
+		drawRunes(region, region.W-runesWidth(mode), s.ModeStyle, mode)
+	}
+}
+
+// formatSize returns a human-readable size of n bytes.
+func formatSize(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, prefix := float64(n)/unit, 0
+	for size >= unit && prefix < 3 {
+		size, prefix = size/unit, prefix+1
+	}
+	return fmt.Sprintf("%.1f %ciB", size, "KMGT"[prefix])
+}
+
+// formatDuration returns d rounded to a precision suitable for reading.
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
 }
 
 type Region struct {
-	W, H    int
-	SetCell func(x, y int, style tcell.Style, ch rune)
+	W, H int
+	// SetCell draws a character, optionally followed by combining characters
+	SetCell func(x, y int, style tcell.Style, ch ...rune)
 }
 
 func TuiRegion(tui tcell.Screen, x, y, w, h int) Region {
 	return Region{
 		W: w, H: h,
-		SetCell: func(dx, dy int, style tcell.Style, ch rune) {
+		SetCell: func(dx, dy int, style tcell.Style, ch ...rune) {
 			if dx >= 0 && dx < w && dy >= 0 && dy < h {
 				if *noColors {
-					style = tcell.StyleDefault
+					// Keep attributes like reverse or bold, which are not colors
+					_, _, attrs := style.Decompose()
+					style = tcell.StyleDefault.
+						Bold(attrs&tcell.AttrBold != 0).
+						Underline(attrs&tcell.AttrUnderline != 0).
+						Reverse(attrs&tcell.AttrReverse != 0).
+						Dim(attrs&tcell.AttrDim != 0)
 				}
-				tui.SetCell(x+dx, y+dy, style, ch)
+				tui.SetCell(x+dx, y+dy, style, ch...)
 			}
 		},
 	}
@@ -883,10 +4205,12 @@ func TuiRegion(tui tcell.Screen, x, y, w, h int) Region {
 var (
 	whiteOnBlue  = tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlue)
 	whiteOnDBlue = tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorNavy)
+	// Styles of the process status in the status bar
+	whiteOnRed    = tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorMaroon)
+	blackOnYellow = tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorYellow)
+	foundStyle    = tcell.StyleDefault.Reverse(true)
 )
 
 func drawText(region Region, style tcell.Style, text string) {
-	for x, ch := range text {
-		region.SetCell(x, 0, style, ch)
-	}
+	drawRunes(region, 0, style, []rune(text))
 }
@@ -1,6 +1,21 @@
 package main
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell"
+)
 
 func Test_Editor_insert(t *testing.T) {
 	tests := []struct {
@@ -82,6 +97,81 @@ func Test_Editor_insert(t *testing.T) {
 	}
 }
 
+func Test_Editor_delete(t *testing.T) {
+	tests := []struct {
+		comment    string
+		e          Editor
+		dx         int
+		wantValue  []rune
+		wantCursor int
+	}{
+		{
+			comment:    "backspace ASCII char",
+			e:          Editor{value: []rune(`abc`), cursor: 2},
+			dx:         -1,
+			wantValue:  []rune(`ac`),
+			wantCursor: 1,
+		},
+		{
+			comment:    "delete ASCII char",
+			e:          Editor{value: []rune(`abc`), cursor: 1},
+			dx:         0,
+			wantValue:  []rune(`ac`),
+			wantCursor: 1,
+		},
+		{
+			comment:    "backspace at start",
+			e:          Editor{value: []rune(`abc`), cursor: 0},
+			dx:         -1,
+			wantValue:  []rune(`abc`),
+			wantCursor: 0,
+		},
+		{
+			comment:    "delete at end",
+			e:          Editor{value: []rune(`abc`), cursor: 3},
+			dx:         0,
+			wantValue:  []rune(`abc`),
+			wantCursor: 3,
+		},
+		{
+			comment:    "backspace char with combining accent",
+			e:          Editor{value: []rune("ae\u0301b"), cursor: 3},
+			dx:         -1,
+			wantValue:  []rune(`ab`),
+			wantCursor: 1,
+		},
+		{
+			comment:    "delete char with combining accent",
+			e:          Editor{value: []rune("ae\u0301b"), cursor: 1},
+			dx:         0,
+			wantValue:  []rune(`ab`),
+			wantCursor: 1,
+		},
+		{
+			comment:    "backspace emoji joined with ZWJ",
+			e:          Editor{value: []rune("a\U0001F469\u200d\U0001F467"), cursor: 4},
+			dx:         -1,
+			wantValue:  []rune(`a`),
+			wantCursor: 1,
+		},
+		{
+			comment:    "delete wide char",
+			e:          Editor{value: []rune(`a世b`), cursor: 1},
+			dx:         0,
+			wantValue:  []rune(`ab`),
+			wantCursor: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		tt.e.delete(tt.dx)
+		if string(tt.e.value) != string(tt.wantValue) || tt.e.cursor != tt.wantCursor {
+			t.Errorf("%q: bad result\nwant: %q, cursor %d\nhave: %q, cursor %d",
+				tt.comment, tt.wantValue, tt.wantCursor, tt.e.value, tt.e.cursor)
+		}
+	}
+}
+
 func Test_Editor_unix_word_rubout(t *testing.T) {
 	tests := []struct {
 		comment       string
@@ -173,3 +263,1328 @@ func Test_Editor_unix_word_rubout(t *testing.T) {
 		}
 	}
 }
+
+func Test_splitPipeline(t *testing.T) {
+	tests := []struct {
+		comment    string
+		command    string
+		wantStages []string
+	}{
+		{
+			comment:    "single command",
+			command:    `grep foo`,
+			wantStages: []string{`grep foo`},
+		},
+		{
+			comment:    "simple pipeline",
+			command:    `grep foo | sort|uniq -c`,
+			wantStages: []string{`grep foo`, `sort`, `uniq -c`},
+		},
+		{
+			comment:    "quoted and escaped pipes",
+			command:    `grep 'a|b' | grep "c|d" | grep e\|f`,
+			wantStages: []string{`grep 'a|b'`, `grep "c|d"`, `grep e\|f`},
+		},
+		{
+			comment:    "logical or",
+			command:    `grep foo || echo none | wc -l`,
+			wantStages: []string{`grep foo || echo none | wc -l`},
+		},
+		{
+			comment:    "sequence",
+			command:    `echo a; echo b | wc -l`,
+			wantStages: []string{`echo a; echo b | wc -l`},
+		},
+		{
+			comment:    "logical and",
+			command:    `make && ls | sort`,
+			wantStages: []string{`make && ls | sort`},
+		},
+		{
+			comment:    "background job",
+			command:    `sleep 1 & ls | sort`,
+			wantStages: []string{`sleep 1 & ls | sort`},
+		},
+		{
+			comment:    "newline",
+			command:    "echo a\necho b | wc -l",
+			wantStages: []string{"echo a\necho b | wc -l"},
+		},
+		{
+			comment:    "redirections and trailing semicolon",
+			command:    `sort 2>&1 | uniq &>/dev/null;`,
+			wantStages: []string{`sort 2>&1`, `uniq &>/dev/null;`},
+		},
+		{
+			comment:    "compound command",
+			command:    `if true; then echo a || echo b; fi | wc -l`,
+			wantStages: []string{`if true; then echo a || echo b; fi`, `wc -l`},
+		},
+		{
+			comment:    "nested subshells and groups",
+			command:    `(a | b) | { c | d; } | echo $(e | f) "$(g | h)" ` + "`i | j`",
+			wantStages: []string{`(a | b)`, `{ c | d; }`, `echo $(e | f) "$(g | h)" ` + "`i | j`"},
+		},
+		{
+			comment:    "case patterns",
+			command:    `while read x; do case $x in a|b) echo $x;; esac; done | sort`,
+			wantStages: []string{`while read x; do case $x in a|b) echo $x;; esac; done`, `sort`},
+		},
+		{
+			comment:    "pipe with stderr",
+			command:    `foo |& grep err`,
+			wantStages: []string{`foo 2>&1`, `grep err`},
+		},
+		{
+			comment:    "comment",
+			command:    `grep x # a | b`,
+			wantStages: []string{`grep x # a | b`},
+		},
+		{
+			comment:    "unfinished last stage",
+			command:    `grep x | `,
+			wantStages: []string{`grep x`},
+		},
+	}
+
+	for _, tt := range tests {
+		stages := splitPipeline(tt.command)
+		if fmt.Sprintf("%q", stages) != fmt.Sprintf("%q", tt.wantStages) {
+			t.Errorf("%q: bad stages\nwant: %q\nhave: %q", tt.comment, tt.wantStages, stages)
+		}
+	}
+}
+
+func Test_History(t *testing.T) {
+	dir, err := ioutil.TempDir("", "up-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "up", "history")
+
+	h, err := LoadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"grep foo", "sort", "sort", "", "grep bar | wc -l"} {
+		if err := h.Add(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err = LoadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"grep foo", "sort", "grep bar | wc -l"}
+	if fmt.Sprintf("%q", h.entries) != fmt.Sprintf("%q", want) {
+		t.Fatalf("bad entries after reload\nwant: %q\nhave: %q", want, h.entries)
+	}
+
+	steps := []struct {
+		comment string
+		do      func() string
+		want    string
+	}{
+		{"prev from draft", func() string { return h.Prev("dra") }, "grep bar | wc -l"},
+		{"prev", func() string { return h.Prev("ignored") }, "sort"},
+		{"prev", func() string { return h.Prev("ignored") }, "grep foo"},
+		{"prev at oldest", func() string { return h.Prev("grep foo") }, "grep foo"},
+		{"next", func() string { return h.Next() }, "sort"},
+		{"next", func() string { return h.Next() }, "grep bar | wc -l"},
+		{"next back to draft", func() string { return h.Next() }, "dra"},
+		{"next at draft", func() string { return h.Next() }, "dra"},
+	}
+	for _, tt := range steps {
+		if have := tt.do(); have != tt.want {
+			t.Errorf("%q: bad value\nwant: %q\nhave: %q", tt.comment, tt.want, have)
+		}
+	}
+
+	if i := h.Search("grep", 2); i != 2 {
+		t.Errorf("search from newest: want 2, have %d", i)
+	}
+	if i := h.Search("grep", 1); i != 0 {
+		t.Errorf("search from middle: want 0, have %d", i)
+	}
+	if i := h.Search("awk", 2); i != -1 {
+		t.Errorf("search not found: want -1, have %d", i)
+	}
+}
+
+func Test_Editor_undo(t *testing.T) {
+	typ := func(s string) func(e *Editor) {
+		return func(e *Editor) {
+			for _, ch := range s {
+				e.HandleKey(tcell.NewEventKey(tcell.KeyRune, ch, tcell.ModNone))
+			}
+		}
+	}
+	press := func(k tcell.Key) func(e *Editor) {
+		return func(e *Editor) { e.HandleKey(tcell.NewEventKey(k, 0, tcell.ModCtrl)) }
+	}
+	tests := []struct {
+		comment    string
+		steps      []func(e *Editor)
+		wantValue  string
+		wantCursor int
+	}{
+		{
+			comment:    "undo typed word",
+			steps:      []func(e *Editor){typ("grep"), press(tcell.KeyCtrlZ)},
+			wantValue:  ``,
+			wantCursor: 0,
+		},
+		{
+			comment:    "undo typed words one by one",
+			steps:      []func(e *Editor){typ("grep foo"), press(tcell.KeyCtrlZ)},
+			wantValue:  `grep `,
+			wantCursor: 5,
+		},
+		{
+			comment:    "undo kill",
+			steps:      []func(e *Editor){typ("grep foo"), press(tcell.KeyCtrlA), press(tcell.KeyCtrlK), press(tcell.KeyCtrlZ)},
+			wantValue:  `grep foo`,
+			wantCursor: 0,
+		},
+		{
+			comment:    "undo word rubout and yank",
+			steps:      []func(e *Editor){typ("grep foo"), press(tcell.KeyCtrlW), press(tcell.KeyCtrlY), press(tcell.KeyCtrlY), press(tcell.KeyCtrlUnderscore), press(tcell.KeyCtrlUnderscore)},
+			wantValue:  `grep `,
+			wantCursor: 5,
+		},
+		{
+			comment:    "moving cursor splits typed characters",
+			steps:      []func(e *Editor){typ("ab"), press(tcell.KeyCtrlA), typ("c"), press(tcell.KeyCtrlZ)},
+			wantValue:  `ab`,
+			wantCursor: 0,
+		},
+		{
+			comment:    "redo",
+			steps:      []func(e *Editor){typ("grep foo"), press(tcell.KeyCtrlW), press(tcell.KeyCtrlZ), press(tcell.KeyCtrlZ), func(e *Editor) { e.redo(); e.redo() }},
+			wantValue:  `grep `,
+			wantCursor: 5,
+		},
+		{
+			comment:    "new edit clears redo",
+			steps:      []func(e *Editor){typ("grep foo"), press(tcell.KeyCtrlZ), typ("x"), func(e *Editor) { e.redo() }},
+			wantValue:  `grep x`,
+			wantCursor: 6,
+		},
+	}
+
+	for _, tt := range tests {
+		e := NewEditor("| ", "")
+		for _, step := range tt.steps {
+			step(e)
+		}
+		if string(e.value) != tt.wantValue || e.cursor != tt.wantCursor {
+			t.Errorf("%q: bad state\nwant: %q @%d\nhave: %q @%d", tt.comment, tt.wantValue, tt.wantCursor, e.value, e.cursor)
+		}
+	}
+}
+
+func Test_Buf_Grow(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*bufChunk/16+1)
+	b := NewBuf(bufChunk + 10).StartCapturing(bytes.NewReader(data), func() {})
+
+	have, err := ioutil.ReadAll(b.NewReader(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, data[:bufChunk+10]) {
+		t.Fatalf("bad data in full buffer: want %d bytes, have %d", bufChunk+10, len(have))
+	}
+
+	b.Grow(len(data))
+	have, err = ioutil.ReadAll(b.NewReader(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, data) {
+		t.Fatalf("bad data in grown buffer: want %d bytes, have %d", len(data), len(have))
+	}
+	if snap, _ := ioutil.ReadAll(b.Snapshot().NewReader(true)); !bytes.Equal(snap, data) {
+		t.Errorf("bad data in snapshot: want %d bytes, have %d", len(data), len(snap))
+	}
+}
+
+func Test_Buf_spill(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5*bufChunk/16+7)
+	b := NewBuf(0)
+	b.spillAt = 2*bufChunk - 100
+	b.StartCapturing(bytes.NewReader(data), func() {})
+
+	have, err := ioutil.ReadAll(b.NewReader(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, data) {
+		t.Fatalf("bad data in spilled buffer: want %d bytes, have %d", len(data), len(have))
+	}
+	if len(b.chunks) != 2 || b.spill == nil {
+		t.Errorf("bad spill: want 2 chunks in memory and spill file, have %d chunks and spill=%v", len(b.chunks), b.spill)
+	}
+	if _, err := os.Stat(b.spill.Name()); !os.IsNotExist(err) {
+		t.Errorf("spill file %s not unlinked: %v", b.spill.Name(), err)
+	}
+}
+
+func Test_Buf_spill_error(t *testing.T) {
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", "/nonexistent/up-test")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*bufChunk/16)
+	b := NewBuf(1000 * bufChunk)
+	b.spillAt = bufChunk
+	b.StartCapturing(bytes.NewReader(data), func() {})
+
+	done := make(chan []byte)
+	go func() {
+		have, _ := ioutil.ReadAll(b.NewReader(true))
+		done <- have
+	}()
+	select {
+	case have := <-done:
+		if !bytes.Equal(have, data[:bufChunk]) {
+			t.Errorf("bad data in failed buffer: want %d bytes, have %d", bufChunk, len(have))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("buffer still capturing after spill error")
+	}
+	if b.Err() == nil || b.State() != "truncated" {
+		t.Errorf("spill error not reported: err=%v, state=%q", b.Err(), b.State())
+	}
+}
+
+func Test_removeSpillFiles(t *testing.T) {
+	f, err := ioutil.TempFile("", "up-test-spill-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spillFiles.files = append(spillFiles.files, f)
+	removeSpillFiles()
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("spill file %s not removed: %v", f.Name(), err)
+	}
+	if len(spillFiles.files) != 0 {
+		t.Errorf("spill files not forgotten: %v", spillFiles.files)
+	}
+}
+
+func Test_Buf_lines(t *testing.T) {
+	var data []byte
+	for i := 0; i < 3*bufChunk/10; i++ {
+		data = append(data, fmt.Sprintf("line %03d\n", i%1000)...)
+	}
+	data = append(data, "last"...)
+	b := NewBuf(0)
+	b.spillAt = bufChunk
+	b.StartCapturing(bytes.NewReader(data), func() {})
+	ioutil.ReadAll(b.NewReader(true))
+
+	lines := bytes.Split(data, []byte("\n"))
+	if b.Lines() != len(lines) {
+		t.Fatalf("bad number of lines: want %d, have %d", len(lines), b.Lines())
+	}
+	if want := (len(lines) - 1) / lineIndexStep; len(b.lineIndex) != want {
+		t.Errorf("bad line index: want %d entries, have %d", want, len(b.lineIndex))
+	}
+	for _, y := range []int{0, 1, lineIndexStep - 1, lineIndexStep, lineIndexStep + 1, 6553, 6554, 13107, len(lines) - 1, len(lines) + 5} {
+		want := lines[len(lines)-1]
+		if y < len(lines) {
+			want = lines[y]
+		}
+		have, _ := bufio.NewReader(b.NewReaderAt(b.LineOffset(y), false)).ReadBytes('\n')
+		have = bytes.TrimSuffix(have, []byte("\n"))
+		if !bytes.Equal(have, want) {
+			t.Errorf("bad line %d: want %q, have %q", y, want, have)
+		}
+	}
+}
+
+// testRegion returns a Region of size w×h, and a function returning its
+// contents as rows separated with '|'.
+func testRegion(w, h int) (Region, func() string) {
+	rows := make([][]string, h)
+	for y := range rows {
+		rows[y] = strings.Split(strings.Repeat(".", w), "")
+	}
+	region := Region{
+		W: w, H: h,
+		SetCell: func(x, y int, style tcell.Style, ch ...rune) {
+			if x >= 0 && x < w && y >= 0 && y < h {
+				rows[y][x] = string(ch)
+			}
+		},
+	}
+	return region, func() string {
+		var s []string
+		for _, row := range rows {
+			s = append(s, strings.Join(row, ""))
+		}
+		return strings.Join(s, "|")
+	}
+}
+
+func Test_BufView_Follow(t *testing.T) {
+	r, w := io.Pipe()
+	v := BufView{Buf: NewBuf(0).StartCapturing(r, func() {})}
+	region, screen := testRegion(4, 2)
+	waitSize := func(n int) {
+		for v.Buf.Size() < n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	io.WriteString(w, "a\nb\nc\n")
+	waitSize(6)
+	v.HandleKey(tcell.NewEventKey(tcell.KeyEnd, 0, tcell.ModNone), region.H)
+	v.DrawTo(region)
+	if have := screen(); have != "b   |c   " || !v.Follow {
+		t.Errorf("after End: want \"b   |c   \" with follow, have %q with follow=%v", have, v.Follow)
+	}
+
+	io.WriteString(w, "d\ne")
+	waitSize(9)
+	v.DrawTo(region)
+	if have := screen(); have != "d   |e   " {
+		t.Errorf("follow: want \"d   |e   \", have %q", have)
+	}
+
+	v.HandleKey(tcell.NewEventKey(tcell.KeyUp, 0, tcell.ModNone), region.H)
+	io.WriteString(w, "\nf\n")
+	waitSize(12)
+	v.DrawTo(region)
+	if have := screen(); have != "c   |d   " || v.Follow {
+		t.Errorf("after Up: want \"c   |d   \" without follow, have %q with follow=%v", have, v.Follow)
+	}
+	w.Close()
+}
+
+func Test_BufView_Follow_wrap(t *testing.T) {
+	v := BufView{Buf: NewBuf(0).StartCapturing(strings.NewReader("a\nbcdef\ni\n"), func() {}), Wrap: true}
+	ioutil.ReadAll(v.Buf.NewReader(true))
+	region, screen := testRegion(4, 3)
+	v.DrawTo(region)
+	v.HandleKey(tcell.NewEventKey(tcell.KeyEnd, 0, tcell.ModNone), region.H)
+	v.DrawTo(region)
+	if have, want := screen(), "bcd\\|ef  |i   "; have != want || v.Y != 1 {
+		t.Errorf("after End: want %q at line 1, have %q at line %d", want, have, v.Y)
+	}
+}
+
+func Test_BufView_FindNext(t *testing.T) {
+	data := "foo\nbar\n\tbaz foo\nqux\nfoo bar\n" + strings.Repeat("x", 100) + "foo\n"
+	v := BufView{Buf: NewBuf(0).StartCapturing(strings.NewReader(data), func() {})}
+	ioutil.ReadAll(v.Buf.NewReader(true))
+	v.Search = regexp.MustCompile(regexp.QuoteMeta("foo"))
+
+	steps := []struct {
+		forward bool
+		wantY   int
+		wantX   int
+		wantOK  bool
+	}{
+		{true, 2, 0, true},
+		{true, 4, 0, true},
+		{true, 5, 80, true},
+		{true, 5, 80, false},
+		{false, 4, 0, true},
+		{false, 2, 0, true},
+		{false, 0, 0, true},
+		{false, 0, 0, false},
+	}
+	for i, tt := range steps {
+		ok := v.FindNext(tt.forward, 40)
+		if ok != tt.wantOK || v.Y != tt.wantY || v.X != tt.wantX {
+			t.Errorf("step %d: want Y=%d X=%d found=%v, have Y=%d X=%d found=%v",
+				i, tt.wantY, tt.wantX, tt.wantOK, v.Y, v.X, ok)
+		}
+	}
+}
+
+func Test_BufView_FindNext_blocks(t *testing.T) {
+	// Matches around the boundaries of the blocks of indexed lines
+	matches := []int{1, 255, 256, 511, 600}
+	var data []string
+	for y := 0; y < 3*lineIndexStep; y++ {
+		data = append(data, fmt.Sprint("line ", y))
+	}
+	for _, y := range matches {
+		data[y] += " foo"
+	}
+	v := BufView{Buf: NewBuf(0).StartCapturing(strings.NewReader(strings.Join(data, "\n")+"\n"), func() {})}
+	ioutil.ReadAll(v.Buf.NewReader(true))
+	v.Search = regexp.MustCompile("foo")
+
+	v.Y = len(data) - 1
+	for i := len(matches) - 1; i >= 0; i-- {
+		if ok := v.FindNext(false, 40); !ok || v.Y != matches[i] {
+			t.Errorf("backward: want Y=%d found, have Y=%d found=%v", matches[i], v.Y, ok)
+		}
+	}
+	if ok := v.FindNext(false, 40); ok || v.Y != matches[0] {
+		t.Errorf("backward: want Y=%d not found, have Y=%d found=%v", matches[0], v.Y, ok)
+	}
+	for _, y := range matches[1:] {
+		if ok := v.FindNext(true, 40); !ok || v.Y != y {
+			t.Errorf("forward: want Y=%d found, have Y=%d found=%v", y, v.Y, ok)
+		}
+	}
+}
+
+func Test_decodeANSI(t *testing.T) {
+	red := tcell.StyleDefault.Foreground(tcell.ColorMaroon)
+	boldRed := red.Bold(true)
+	tests := []struct {
+		comment    string
+		line       string
+		style      tcell.Style
+		wantText   string
+		wantStyles []tcell.Style
+		wantNext   tcell.Style
+	}{
+		{
+			comment:  "plain text",
+			line:     "foo\tbar\n",
+			wantText: "foo\tbar\n",
+			wantNext: tcell.StyleDefault,
+		},
+		{
+			comment:    "grep --color",
+			line:       "a\x1b[01;31m\x1b[Kb\x1b[m\x1b[Kc\n",
+			wantText:   "abc\n",
+			wantStyles: []tcell.Style{tcell.StyleDefault, boldRed, tcell.StyleDefault, tcell.StyleDefault},
+			wantNext:   tcell.StyleDefault,
+		},
+		{
+			comment:    "style continued from previous line",
+			line:       "a\x1b[22mb",
+			style:      boldRed,
+			wantText:   "ab",
+			wantStyles: []tcell.Style{boldRed, red},
+			wantNext:   red,
+		},
+		{
+			comment:    "256 and RGB colors",
+			line:       "\x1b[38;5;196;48;2;1;2;3ma\x1b[38:2::4:5:6mb",
+			wantText:   "ab",
+			wantStyles: []tcell.Style{tcell.StyleDefault.Foreground(tcell.Color(196)).Background(tcell.NewRGBColor(1, 2, 3)), tcell.StyleDefault.Foreground(tcell.NewRGBColor(4, 5, 6)).Background(tcell.NewRGBColor(1, 2, 3))},
+			wantNext:   tcell.StyleDefault.Foreground(tcell.NewRGBColor(4, 5, 6)).Background(tcell.NewRGBColor(1, 2, 3)),
+		},
+		{
+			comment:    "other escapes and control characters are removed",
+			line:       "\x1b]8;;http://x\x1b\\a\x1b]8;;\x07\x1b(B\x1b[2Jb\rc\x08\u0085d",
+			wantText:   "abcd",
+			wantStyles: []tcell.Style{tcell.StyleDefault, tcell.StyleDefault, tcell.StyleDefault, tcell.StyleDefault},
+			wantNext:   tcell.StyleDefault,
+		},
+		{
+			comment:    "truncated escape",
+			line:       "a\x1b[3",
+			wantText:   "a",
+			wantStyles: []tcell.Style{tcell.StyleDefault},
+			wantNext:   tcell.StyleDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		text, styles, next := decodeANSI([]byte(tt.line), tt.style)
+		if string(text) != tt.wantText {
+			t.Errorf("%q: bad text\nwant: %q\nhave: %q", tt.comment, tt.wantText, text)
+		}
+		if fmt.Sprint(styles) != fmt.Sprint(tt.wantStyles) {
+			t.Errorf("%q: bad styles\nwant: %v\nhave: %v", tt.comment, tt.wantStyles, styles)
+		}
+		if next != tt.wantNext {
+			t.Errorf("%q: bad next style\nwant: %v\nhave: %v", tt.comment, tt.wantNext, next)
+		}
+	}
+}
+
+func Test_BufView_DrawTo_widths(t *testing.T) {
+	tests := []struct {
+		comment string
+		data    string
+		x       int
+		wrap    bool
+		want    string
+	}{
+		{
+			comment: "wide characters and tabs",
+			data:    "a世b\tc\nxy",
+			want:    "a世.b »|xy    ",
+		},
+		{
+			comment: "wide character clipped on the left",
+			data:    "a世b\tc\nxy",
+			x:       2,
+			want:    "«b   »|«     ",
+		},
+		{
+			comment: "wide character clipped on the right",
+			data:    "abcd世x\nabcde世",
+			want:    "abcd »|abcde»",
+		},
+		{
+			comment: "combining characters",
+			data:    "e\u0301x\u200dy\n\u0301z",
+			want:    "e\u0301x\u200dy    | \u0301z    ",
+		},
+		{
+			comment: "wrapped line",
+			data:    "abcdefg\nxy",
+			wrap:    true,
+			want:    "abcde\\|fg    ",
+		},
+		{
+			comment: "wrapped wide character and tab",
+			data:    "abcd世\tx",
+			wrap:    true,
+			want:    "abcd \\|世.   \\",
+		},
+		{
+			comment: "horizontal scrolling is ignored when wrapping",
+			data:    "abcdefg",
+			x:       2,
+			wrap:    true,
+			want:    "abcde\\|fg    ",
+		},
+	}
+
+	for _, tt := range tests {
+		v := BufView{Buf: NewBuf(0).StartCapturing(strings.NewReader(tt.data), func() {}), X: tt.x, Wrap: tt.wrap}
+		ioutil.ReadAll(v.Buf.NewReader(true))
+		region, screen := testRegion(6, 2)
+		v.DrawTo(region)
+		if have := screen(); have != tt.want {
+			t.Errorf("%q: bad screen\nwant: %q\nhave: %q", tt.comment, tt.want, have)
+		}
+	}
+}
+
+func Test_Editor_DrawTo_widths(t *testing.T) {
+	e := NewEditor("| ", "世e\u0301x")
+	region, screen := testRegion(8, 1)
+	var cursor []int
+	for _, k := range []tcell.Key{tcell.KeyLeft, tcell.KeyLeft, tcell.KeyLeft} {
+		e.HandleKey(tcell.NewEventKey(k, 0, tcell.ModNone))
+		e.DrawTo(region, tcell.StyleDefault, func(x, y int) { cursor = append(cursor, x) })
+	}
+	if have, want := screen(), "| 世.e\u0301x.."; have != want {
+		t.Errorf("bad screen\nwant: %q\nhave: %q", want, have)
+	}
+	if have, want := fmt.Sprint(cursor), "[5 4 2]"; have != want {
+		t.Errorf("bad cursor positions\nwant: %s\nhave: %s", want, have)
+	}
+}
+
+func Test_StatusBar(t *testing.T) {
+	tests := []struct {
+		comment string
+		data    string
+		command string
+		want    string
+	}{
+		{
+			comment: "input",
+			data:    "foo\nbar\n",
+			want:    "2 lines  8 B  complete      ",
+		},
+		{
+			comment: "successful command",
+			data:    "foo",
+			command: "cat",
+			want:    "1 line  3 B  complete  exit status 0 in ",
+		},
+		{
+			comment: "failed stage",
+			command: "false | cat",
+			want:    "0 lines  0 B  complete  stage 1: exit status 1 in ",
+		},
+	}
+
+	for _, tt := range tests {
+		status := StatusBar{Buf: NewBuf(0).StartCapturing(strings.NewReader(tt.data), func() {})}
+		ioutil.ReadAll(status.Buf.NewReader(true))
+		if tt.command != "" {
+			p := StartPipeline([]string{"sh", "-c"}, tt.command, status.Buf, func() {})
+			status.Buf, status.Procs = p.Buf(len(p.Stages)), p.Procs(len(p.Stages))
+			ioutil.ReadAll(status.Buf.NewReader(true))
+			for status.Running() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		region, screen := testRegion(len(tt.want)+10, 1)
+		status.DrawTo(region)
+		if have := screen(); !strings.HasPrefix(have, tt.want) {
+			t.Errorf("%q: bad status\nwant prefix: %q\nhave: %q", tt.comment, tt.want, have)
+		}
+	}
+}
+
+func Test_Pipeline_stderr(t *testing.T) {
+	input := NewBuf(0).StartCapturing(strings.NewReader("foo\n"), func() {})
+	p := StartPipeline([]string{"sh", "-c"}, "cat; echo err1 >&2 | cat; echo err2 >&2", input, func() {})
+	for _, tt := range []struct {
+		comment string
+		buf     *Buf
+		want    string
+	}{
+		{"stdout", p.Buf(len(p.Stages)), "foo\n"},
+		{"stderr", p.Stderr, "err1\nerr2\n"},
+	} {
+		have, _ := ioutil.ReadAll(tt.buf.NewReader(true))
+		if string(have) != tt.want {
+			t.Errorf("%s: want %q, have %q", tt.comment, tt.want, have)
+		}
+	}
+}
+
+func Test_formatSize(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{40 * 1024 * 1024, "40.0 MiB"},
+		{3 << 40, "3.0 TiB"},
+	}
+	for _, tt := range tests {
+		if have := formatSize(tt.n); have != tt.want {
+			t.Errorf("formatSize(%d): want %q, have %q", tt.n, tt.want, have)
+		}
+	}
+}
+
+func Test_Throttle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var timers []func()
+	var waits []time.Duration
+	calls := 0
+	throttle := NewThrottle(50*time.Millisecond, func() { calls++ })
+	throttle.now = func() time.Time { return now }
+	throttle.after = func(d time.Duration, f func()) {
+		waits = append(waits, d)
+		timers = append(timers, f)
+	}
+
+	// The first call is immediate, all the others are merged into one
+	for i := 0; i < 20; i++ {
+		throttle.Call()
+		now = now.Add(time.Millisecond)
+	}
+	if calls != 1 || len(timers) != 1 {
+		t.Fatalf("want 1 call and 1 postponed, have %d calls and %d postponed", calls, len(timers))
+	}
+	if want := 49 * time.Millisecond; waits[0] != want {
+		t.Errorf("postponed by %s, want %s", waits[0], want)
+	}
+	now = now.Add(29 * time.Millisecond)
+	timers[0]()
+	if calls != 2 {
+		t.Errorf("want 2 calls after postponed one, have %d", calls)
+	}
+
+	// Calls after the interval passes are immediate again
+	now = now.Add(50 * time.Millisecond)
+	throttle.Call()
+	if calls != 3 || len(timers) != 1 {
+		t.Errorf("want 3 calls and 1 postponed, have %d calls and %d postponed", calls, len(timers))
+	}
+}
+
+func Test_checkSideEffects(t *testing.T) {
+	tests := []struct {
+		command string
+		wantErr string
+	}{
+		{"", ""},
+		{"grep -i foo | sort -n | uniq -c", ""},
+		{"grep foo |", ""},
+		{"jq '.[] | select(.a > 1)' 2>&1", ""},
+		{`LC_ALL=C sort -t, -k2 < input.txt | head -3`, ""},
+		{"cat 2>/dev/null; echo done && wc -l", ""},
+		{`awk '$3 > 100 || $1 == "x" { print $2 }'`, ""},
+		{`sed -n 's/a/b/p' # rm -rf /`, ""},
+		{`echo "$HOME (at) \"x\" > y"`, ""},
+		{"rm -rf /", "rm is not a --safe-commands command"},
+		{"grep foo | tee out", "tee is not a --safe-commands command"},
+		{"grep foo > out", "output redirection"},
+		{"grep foo 2>>errors", "output redirection"},
+		{"grep foo &> out", "output redirection"},
+		{"sort <> file", "output redirection"},
+		{"echo hi >&out.txt", "output redirection"},
+		{"cat >&out.txt", "output redirection"},
+		{"grep x >& out", "output redirection"},
+		{"cat 1>&out", "output redirection"},
+		{"cat 1>&2x", "output redirection"},
+		{"grep x >&2 | sort 3>&- 2>& /dev/null", ""},
+		{"echo $(rm x)", "command substitution"},
+		{"echo \"`rm x`\"", "command substitution"},
+		{"(rm x)", "subshell"},
+		{"diff <(ls) x", "process substitution"},
+		{"sed -i s/a/b/ file", "sed -i may have side effects"},
+		{"sed -ni s/a/b/ file", "sed -ni may have side effects"},
+		{"sed 's/a/b/w out'", "sed s/a/b/w out may have side effects"},
+		{"sort -o out", "sort -o may have side effects"},
+		{"sort --output=out", "sort --output=out may have side effects"},
+		{"uniq in out", "uniq out may have side effects"},
+		{`awk '{ print > "out" }'`, `awk { print > "out" } may have side effects`},
+		{`awk '{ system("rm x") }'`, `awk { system("rm x") } may have side effects`},
+		{`'r''m' x`, "rm is not a --safe-commands command"},
+		{"sed '1 w /tmp/out'", "sed 1 w /tmp/out may have side effects"},
+		{"sed 's/a/b/gw /tmp/out'", "sed s/a/b/gw /tmp/out may have side effects"},
+		{"sed '$!e touch /tmp/pwned'", "sed $!e touch /tmp/pwned may have side effects"},
+		{"sed '/x/I,+2 { p; W out\n}'", "sed /x/I,+2 { p; W out\n} may have side effects"},
+		{"sed 's|a/b|c|e'", "sed s|a/b|c|e may have side effects"},
+		{"sed --expression='w /tmp/out'", "sed w /tmp/out may have side effects"},
+		{"sed -e'w /tmp/out'", "sed w /tmp/out may have side effects"},
+		{"sed -n -e p -e 'w /tmp/out' file", "sed w /tmp/out may have side effects"},
+		{"sed -f script.sed", "sed -f may have side effects"},
+		{"sed --fi=script.sed", "sed --fi=script.sed may have side effects"},
+		{"sed -E -e 's/(a|b)/\\1 w/g; /^$/d; 1i\\' -e 'y/w/e/' w e", ""},
+		{"sed -n '/start/,/end/{ s/x/y/2p; }' -- file", ""},
+		{"sort --compress-program=sh", "sort --compress-program=sh may have side effects"},
+		{"sort --comp sh", "sort --comp may have side effects"},
+		{"sort -to -k2", ""},
+		{"awk -f prog.awk", "awk -f may have side effects"},
+		{"awk -F'|' -v x=1 '{ print $1 }'", ""},
+		{`awk -e '{ print > "out" }'`, `awk { print > "out" } may have side effects`},
+		{`gawk -i inplace '{ print }' file`, "gawk -i may have side effects"},
+		{`gawk '@include "inplace"; { print }' file`, `gawk @include "inplace"; { print } may have side effects`},
+		{`awk '@load "filefuncs"'`, `awk @load "filefuncs" may have side effects`},
+		{`gawk '@namespace "x"'`, `gawk @namespace "x" may have side effects`},
+		{`awk '{ print "a@b" }'`, ""},
+	}
+	for _, tt := range tests {
+		err := checkSideEffects(tt.command, defaultSafeCommands)
+		if have := fmt.Sprint(err); (err != nil || tt.wantErr != "") && have != tt.wantErr {
+			t.Errorf("%q: want error %q, have %q", tt.command, tt.wantErr, have)
+		}
+	}
+}
+
+func Test_setupSandbox_writable(t *testing.T) {
+	// A wrapper which doesn't make the file system read-only is rejected
+	_, err := setupSandbox([]string{"env"})
+	if err == nil || !strings.Contains(err.Error(), "is writable in the sandbox") {
+		t.Errorf("want error about writable file system, have: %v", err)
+	}
+}
+
+func Test_Subprocess_timeout(t *testing.T) {
+	defer func(d time.Duration) { *timeout = d }(*timeout)
+	*timeout = 100 * time.Millisecond
+	input := NewBuf(0).StartCapturing(strings.NewReader(""), func() {})
+	for _, command := range []string{
+		"sleep 10 | sleep 10",
+		// Must be killed with SIGKILL
+		"trap '' TERM; sleep 10",
+	} {
+		start := time.Now()
+		p := StartSubprocess([]string{"sh", "-c"}, command, input, ioutil.Discard, func() {})
+		ioutil.ReadAll(p.Buf.NewReader(true))
+		done, err := p.Finished()
+		for !done {
+			time.Sleep(time.Millisecond)
+			done, err = p.Finished()
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%q: process group not killed after timeout, finished in %s", command, d)
+		}
+		if want := "killed after exceeding --timeout (100ms)"; fmt.Sprint(err) != want {
+			t.Errorf("%q: want error %q, have %q", command, want, err)
+		}
+	}
+}
+
+func Test_argsCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"grep", "-i"}, "grep -i"},
+		{[]string{"sort | uniq -c"}, "sort | uniq -c"},
+		{[]string{"jq", ".[] | .name"}, "jq '.[] | .name'"},
+		{[]string{"grep", "it's", ""}, `grep 'it'\''s' ''`},
+		{[]string{"cut", "-d,", "-f2-3", "/tmp/a.csv"}, "cut -d, -f2-3 /tmp/a.csv"},
+	}
+	for _, tt := range tests {
+		if have := argsCommand(tt.args); have != tt.want {
+			t.Errorf("%q: want %q, have %q", tt.args, tt.want, have)
+		}
+	}
+}
+
+func Test_ReadScript(t *testing.T) {
+	tests := []struct {
+		comment    string
+		script     string
+		wantScript *Script
+		wantErr    bool
+	}{
+		{
+			comment:    "written by up",
+			script:     "#!/bin/bash\ngrep -i foo | sort\n",
+			wantScript: &Script{Interpreter: "/bin/bash", Shell: []string{"/bin/bash", "-c"}, Command: "grep -i foo | sort"},
+		},
+		{
+			comment:    "env with arguments",
+			script:     "#!/usr/bin/env -S bash -e\r\n\r\nwc -l\r\n",
+			wantScript: &Script{Interpreter: "/usr/bin/env -S bash -e", Shell: []string{"bash", "-e", "-c"}, Command: "wc -l"},
+		},
+		{
+			comment:    "env with quoted arguments",
+			script:     "#!/usr/bin/env -S zsh -o 'a b'\ncat\n",
+			wantScript: &Script{Interpreter: "/usr/bin/env -S zsh -o 'a b'", Shell: []string{"zsh", "-o", "a b", "-c"}, Command: "cat"},
+		},
+		{
+			comment:    "input and other comments",
+			script:     "#!/usr/bin/env bash\n# input: lshw\n# TODO: sort\ngrep net\n",
+			wantScript: &Script{Interpreter: "/usr/bin/env bash", Shell: []string{"bash", "-c"}, Command: "grep net", Input: "lshw"},
+		},
+		{
+			comment:    "empty pipeline",
+			script:     "#!/bin/sh\n\n",
+			wantScript: &Script{Interpreter: "/bin/sh", Shell: []string{"/bin/sh", "-c"}},
+		},
+		{
+			comment: "no interpreter",
+			script:  "grep foo\n",
+			wantErr: true,
+		},
+		{
+			comment: "multi-line",
+			script:  "#!/bin/sh\ncd /tmp\nls\n",
+			wantErr: true,
+		},
+	}
+	dir, err := ioutil.TempDir("", "up-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		path := filepath.Join(dir, "up.sh")
+		err := ioutil.WriteFile(path, []byte(tt.script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, err := ReadScript(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: want error %v, have %v", tt.comment, tt.wantErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(script, tt.wantScript) {
+			t.Errorf("%s: want %#v, have %#v", tt.comment, tt.wantScript, script)
+		}
+	}
+}
+
+func Test_Script_Format(t *testing.T) {
+	tests := []struct {
+		comment string
+		script  Script
+		format  string
+		want    string
+	}{
+		{
+			comment: "default shell",
+			script:  Script{Shell: []string{"/bin/bash", "-c"}, Command: "grep x | sort"},
+			format:  "script",
+			want:    "#!/bin/bash\ngrep x | sort\n",
+		},
+		{
+			comment: "shell from $PATH, with input",
+			script:  Script{Shell: []string{"bash", "-c"}, Command: "wc -l", Input: "lshw"},
+			format:  "script",
+			want:    "#!/usr/bin/env bash\n# input: lshw\nwc -l\n",
+		},
+		{
+			comment: "multi-word shell",
+			script:  Script{Shell: []string{"bash", "-o", "pipefail", "-c"}, Command: "wc -l"},
+			format:  "script",
+			want:    "#!/usr/bin/env -S bash -o pipefail\nwc -l\n",
+		},
+		{
+			comment: "interpreter of a loaded script",
+			script:  Script{Interpreter: "/bin/bash -e", Shell: []string{"/bin/bash", "-e", "-c"}, Command: "wc -l"},
+			format:  "script",
+			want:    "#!/bin/bash -e\nwc -l\n",
+		},
+		{
+			comment: "shell not taking a script",
+			script:  Script{Shell: []string{"perl", "-nle"}, Command: "print $1 if /(x+)/"},
+			format:  "script",
+			want:    "#!/bin/sh\nexec perl -nle 'print $1 if /(x+)/'\n",
+		},
+		{
+			comment: "function",
+			script:  Script{Shell: []string{"/bin/bash", "-c"}, Command: "grep x | sort", Input: "dmesg"},
+			format:  "function",
+			want:    "# input: dmesg\nup1() {\n\tgrep x | sort\n}\n",
+		},
+		{
+			comment: "function of other shell",
+			script:  Script{Shell: []string{"fish", "-c"}, Command: "echo $x"},
+			format:  "function",
+			want:    "up1() {\n\tfish -c 'echo $x'\n}\n",
+		},
+		{
+			comment: "make",
+			script:  Script{Shell: []string{"/bin/bash", "-c"}, Command: "awk '{print $2}'"},
+			format:  "make",
+			want:    ".PHONY: up1\nup1:\n\t/bin/bash -c 'awk '\\''{print $$2}'\\'''\n",
+		},
+	}
+	for _, tt := range tests {
+		if have := tt.script.Format(tt.format, "up1"); have != tt.want {
+			t.Errorf("%s: want %q, have %q", tt.comment, tt.want, have)
+		}
+	}
+}
+
+func Test_scriptName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"up1.sh", "up1"},
+		{"/tmp/up-123.mk", "up_123"},
+		{"lshw net.sh", "lshw_net"},
+		{"1.sh", "up1"},
+	}
+	for _, tt := range tests {
+		if have := scriptName(tt.path); have != tt.want {
+			t.Errorf("%q: want %q, have %q", tt.path, tt.want, have)
+		}
+	}
+}
+
+func Test_readFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "up-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{"a.log": "foo\n", "b.log": "bar\n", "c.txt": "baz\n"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		comment  string
+		patterns []string
+		want     string
+		wantErr  bool
+	}{
+		{
+			comment:  "glob",
+			patterns: []string{filepath.Join(dir, "*.log")},
+			want:     "foo\nbar\n",
+		},
+		{
+			comment:  "files in order given",
+			patterns: []string{filepath.Join(dir, "c.txt"), filepath.Join(dir, "a.log")},
+			want:     "baz\nfoo\n",
+		},
+		{
+			comment:  "missing file",
+			patterns: []string{filepath.Join(dir, "a.log"), filepath.Join(dir, "d.log")},
+			wantErr:  true,
+		},
+		{
+			comment:  "directory",
+			patterns: []string{dir},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		paths, err := globInputs(tt.patterns)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: want error %v, have %v", tt.comment, tt.wantErr, err)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		have, err := ioutil.ReadAll(readFiles(paths, nil))
+		if err != nil || string(have) != tt.want {
+			t.Errorf("%s: want %q, have %q (error: %v)", tt.comment, tt.want, have, err)
+		}
+	}
+
+	// File removed after the check is reported, and the remaining ones are
+	// still read
+	r := readFiles([]string{filepath.Join(dir, "d.log"), filepath.Join(dir, "a.log")}, nil)
+	have, _ := ioutil.ReadAll(r)
+	if !strings.HasPrefix(string(have), "up: open ") || !strings.HasSuffix(string(have), "foo\n") {
+		t.Errorf("missing file: have %q", have)
+	}
+
+	// Reading stops when requested
+	stop := make(chan struct{})
+	close(stop)
+	have, _ = ioutil.ReadAll(readFiles([]string{filepath.Join(dir, "a.log")}, stop))
+	if len(have) != 0 {
+		t.Errorf("stopped: want nothing, have %q", have)
+	}
+}
+
+func Test_StartInput(t *testing.T) {
+	p := StartInput([]string{"sh", "-c"}, "echo out; echo err >&2", NewBuf(0), func() {})
+	have, _ := ioutil.ReadAll(p.Buf.NewReader(true))
+	if want := "out\nerr\n"; string(have) != want {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	p.Wait()
+	if _, err := p.Finished(); err != nil {
+		t.Errorf("want no error, have %v", err)
+	}
+}
+
+func Test_History_errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "up-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A directory can't be read nor appended to as a file
+	h, err := LoadHistory(dir)
+	if err == nil {
+		t.Errorf("load: want error, have nil")
+	}
+	if err := h.Add("sort"); err == nil {
+		t.Errorf("add: want error, have nil")
+	}
+	if have := h.Prev(""); have != "sort" {
+		t.Errorf("prev: want %q, have %q", "sort", have)
+	}
+}
+
+func Test_Buf_Snapshot(t *testing.T) {
+	r, w := io.Pipe()
+	b := NewBuf(0).StartCapturing(r, func() {})
+	w.Write([]byte("one\ntwo\n"))
+	for b.Size() < 8 {
+		time.Sleep(time.Millisecond)
+	}
+	snap := b.Snapshot()
+	// New data lands in the same chunk of memory as the snapshotted data
+	w.Write([]byte("three\n"))
+	w.Close()
+
+	have, _ := ioutil.ReadAll(b.NewReader(true))
+	if want := "one\ntwo\nthree\n"; string(have) != want {
+		t.Errorf("buffer: want %q, have %q", want, have)
+	}
+	have, _ = ioutil.ReadAll(snap.NewReader(true))
+	if want := "one\ntwo\n"; string(have) != want {
+		t.Errorf("snapshot: want %q, have %q", want, have)
+	}
+	if snap.Lines() != 3 || snap.State() != "complete" {
+		t.Errorf("snapshot: want 3 lines, complete; have %d lines, %s", snap.Lines(), snap.State())
+	}
+}
+
+func Test_Snapshot_Restore(t *testing.T) {
+	snapshots := []Snapshot{
+		{Command: "grep foo", Buf: NewBuf(0).StartCapturing(strings.NewReader("foo\n"), func() {})},
+		{Command: "sort", Buf: NewBuf(0).StartCapturing(strings.NewReader("a\nb\nc\n"), func() {})},
+	}
+	menu := NewSnapshotMenu(snapshots)
+	if want := []string{"  1 | grep foo", "  2 | sort"}; !reflect.DeepEqual(menu.Items, want) || menu.Selected != 1 {
+		t.Fatalf("menu: want %q with #1 selected, have %q with #%d", want, menu.Items, menu.Selected)
+	}
+
+	editor := NewEditor("| ", "uniq -c")
+	view := BufView{Y: 100, Buf: NewBuf(0)}
+	snap := snapshots[menu.Selected]
+	ioutil.ReadAll(snap.Buf.NewReader(true))
+	snap.Restore(editor, &view)
+	if editor.String() != "sort" {
+		t.Errorf("editor: want %q, have %q", "sort", editor.String())
+	}
+	if view.Buf != snap.Buf || view.Y != snap.Buf.Lines()-1 {
+		t.Errorf("view: want snapshot buffer at Y=%d, have Y=%d", snap.Buf.Lines()-1, view.Y)
+	}
+	// Restoring is an edit of the command, which can be undone
+	editor.undo()
+	if editor.String() != "uniq -c" {
+		t.Errorf("undo: want %q, have %q", "uniq -c", editor.String())
+	}
+}
+
+func Test_forkStack(t *testing.T) {
+	input := NewBuf(0)
+	grepped, sorted := NewBuf(0), NewBuf(0)
+	var forks forkStack
+	if forks.prompt() != "| " || forks.base(input) != input || forks.command("wc") != "wc" {
+		t.Fatalf("empty: bad prompt %q, base or command %q", forks.prompt(), forks.command("wc"))
+	}
+
+	// Fork on output of 'grep foo', and then on output of 'sort'; a
+	// snapshot without a command is forked in between
+	forks.push(fork{input: input, command: "grep foo"})
+	forks.push(fork{input: grepped, command: ""})
+	forks.push(fork{input: grepped, command: "sort"})
+	steps := []struct {
+		comment     string
+		edited      string
+		wantCommand string
+		wantPrompt  string
+	}{
+		{"full command", "uniq -c", "grep foo | sort | uniq -c", "[3]| "},
+		{"full command, nothing edited", "", "grep foo | sort", "[3]| "},
+	}
+	for _, tt := range steps {
+		if have := forks.command(tt.edited); have != tt.wantCommand {
+			t.Errorf("%s: want %q, have %q", tt.comment, tt.wantCommand, have)
+		}
+		if have := forks.prompt(); have != tt.wantPrompt {
+			t.Errorf("%s: want prompt %q, have %q", tt.comment, tt.wantPrompt, have)
+		}
+	}
+	if forks.base(sorted) != input {
+		t.Errorf("base: want original input")
+	}
+
+	pops := []struct {
+		edited      string
+		wantInput   *Buf
+		wantCommand string
+		wantPrompt  string
+	}{
+		{"uniq -c", grepped, "sort | uniq -c", "[2]| "},
+		{"sort | uniq -c", grepped, "sort | uniq -c", "[1]| "},
+		{"", input, "grep foo", "| "},
+	}
+	for i, tt := range pops {
+		f, cmd := forks.pop(tt.edited)
+		if f.input != tt.wantInput || cmd != tt.wantCommand || forks.prompt() != tt.wantPrompt {
+			t.Errorf("pop #%d: want command %q, prompt %q; have %q, %q", i+1, tt.wantCommand, tt.wantPrompt, cmd, forks.prompt())
+		}
+	}
+	if forks.base(input) != input {
+		t.Errorf("base after unforking: want original input")
+	}
+}
+
+func Test_Pipeline_KillAfter(t *testing.T) {
+	input := NewBuf(0).StartCapturing(strings.NewReader("a\n"), func() {})
+	p := StartPipeline([]string{"sh", "-c"}, "cat | cat | sleep 10", input, func() {})
+	p.KillAfter(2)
+	have, _ := ioutil.ReadAll(p.Buf(2).NewReader(true))
+	if string(have) != "a\n" {
+		t.Errorf("kept stage: want %q, have %q", "a\n", have)
+	}
+	start := time.Now()
+	p.Wait()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("killed stage still running after %s", d)
+	}
+	for i, s := range p.procs {
+		_, err := s.Finished()
+		if killed := i == 2; (err != nil) != killed {
+			t.Errorf("stage %d: want killed %v, have error %v", i+1, killed, err)
+		}
+	}
+}
+
+func Test_Pipeline_Failed(t *testing.T) {
+	tests := []struct {
+		comment string
+		command string
+		kill    bool
+		want    bool
+	}{
+		{comment: "success", command: "true", want: false},
+		{comment: "grep with no matches", command: "grep nomatch", want: false},
+		{comment: "exit status 1 in earlier stage", command: "false | cat", want: false},
+		{comment: "error message", command: "echo oops >&2; exit 1", want: true},
+		{comment: "error message without error", command: "echo warning >&2", want: false},
+		{comment: "exit status above 1", command: "exit 2", want: true},
+		{comment: "unknown command", command: "nonexistent-up-command", want: true},
+		{comment: "killed by other signal", command: "kill -KILL $$", want: true},
+		{comment: "cancelled", command: "sleep 10", kill: true, want: false},
+	}
+
+	for _, tt := range tests {
+		input := NewBuf(0).StartCapturing(strings.NewReader("foo\n"), func() {})
+		p := StartPipeline([]string{"sh", "-c"}, tt.command, input, func() {})
+		if tt.kill {
+			time.Sleep(50 * time.Millisecond)
+			p.Kill()
+		}
+		p.Wait()
+		ioutil.ReadAll(p.Stderr.NewReader(true))
+		if have := p.Failed(); have != tt.want {
+			t.Errorf("%q: want failed=%v, have %v", tt.comment, tt.want, have)
+		}
+	}
+}
+
+func Test_drawLastGood(t *testing.T) {
+	view := BufView{Buf: NewBuf(0).StartCapturing(strings.NewReader("old\nout\n"), func() {})}
+	ioutil.ReadAll(view.Buf.NewReader(true))
+	region, screen := testRegion(12, 3)
+	dimmed := map[int]bool{}
+	setCell := region.SetCell
+	region.SetCell = func(x, y int, style tcell.Style, ch ...rune) {
+		_, _, attrs := style.Decompose()
+		dimmed[y] = attrs&tcell.AttrDim != 0
+		setCell(x, y, style, ch...)
+	}
+	drawLastGood(region, &view, "grep foo")
+	if have, want := screen(), "command fail|old         |out         "; have != want {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if dimmed[0] || !dimmed[1] || !dimmed[2] {
+		t.Errorf("want dimmed output below banner, have dimmed rows %v", dimmed)
+	}
+}
+
+func Test_Subprocess_Kill_fullBuf(t *testing.T) {
+	input := NewBuf(bufChunk).StartCapturing(strings.NewReader(""), func() {})
+	p := StartSubprocess([]string{"sh", "-c"}, "yes", input, ioutil.Discard, func() {})
+	for p.Buf.Size() < bufChunk {
+		time.Sleep(time.Millisecond)
+	}
+	p.Kill()
+	waited := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process with full buffer not finished after Kill")
+	}
+	if p.Buf.State() != "complete" || p.Buf.Size() != bufChunk {
+		t.Errorf("want complete buffer of %d bytes, have %s of %d bytes", bufChunk, p.Buf.State(), p.Buf.Size())
+	}
+}
+
+func Test_Subprocess_Finished_liveInput(t *testing.T) {
+	// Input which is never closed, like from `tail -f`
+	r, w := io.Pipe()
+	defer w.Close()
+	input := NewBuf(0).StartCapturing(r, func() {})
+	w.Write([]byte("foo\nbar\n"))
+	for _, command := range []string{"head -1", "true", "sleep 0.1"} {
+		p := StartSubprocess([]string{"sh", "-c"}, command, input, ioutil.Discard, func() {})
+		deadline := time.Now().Add(5 * time.Second)
+		for done, _ := p.Finished(); !done; done, _ = p.Finished() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%q: not finished after its process exited", command)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}